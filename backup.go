@@ -0,0 +1,314 @@
+package ivy
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrBadBackup is returned by Restore when its input is not an Ivy backup.
+var ErrBadBackup = errors.New("ivy: not an ivy backup")
+
+// Type BackupOptions holds the optional settings for Backup. Gzip compresses
+// the archive. Since, when set, makes an incremental backup holding only the
+// files modified since then, normally the Time of the previous backup's
+// manifest. Files modified up to a second before Since are included again, to
+// allow for file systems with coarse timestamps.
+type BackupOptions struct {
+	Gzip  bool
+	Since time.Time
+}
+
+// Type BackupManifest describes a backup. It is stored as the first entry of
+// the archive. Files lists every file of the backed up tables at the time of
+// the backup, including those an incremental backup leaves out, so that
+// Restore can remove the files deleted since the previous backup.
+type BackupManifest struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Since   time.Time `json:"since,omitempty"`
+	Tables  []string  `json:"tables"`
+	Files   []string  `json:"files"`
+}
+
+// backupManifestName is the name of the manifest entry of a backup archive.
+const backupManifestName = "ivy-backup.json"
+
+// backupSlack is how far before Since an incremental backup looks for
+// modified files.
+const backupSlack = time.Second
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// Backup writes a consistent snapshot of the database as a tar archive, which
+// Restore turns back into a database directory. Every table is read locked
+// for the duration of the backup, so the database stays readable but writes
+// wait until the backup is done. Files are archived as stored, so encrypted
+// tables stay encrypted. It takes a writer and options, which may be nil. It
+// returns the backup's manifest, whose Time is the Since of the next
+// incremental backup, and any error encountered.
+func (db *DB) Backup(w io.Writer, opts *BackupOptions) (*BackupManifest, error) {
+	var tblNames []string
+	var changed []string
+
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+
+	for tblName := range db.rwLocks {
+		tblNames = append(tblNames, tblName)
+	}
+	sort.Strings(tblNames)
+
+	unlock := db.lockTbls(nil, tblNames)
+	defer unlock()
+
+	manifest := &BackupManifest{Version: 1, Time: time.Now().UTC(), Since: opts.Since, Tables: tblNames, Files: []string{}}
+	cutoff := opts.Since.Add(-backupSlack)
+
+	for _, tblName := range tblNames {
+		err := filepath.Walk(db.tblPath(tblName), func(filename string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || strings.HasSuffix(filename, ".tmp") {
+				return err
+			}
+
+			name, err := filepath.Rel(db.path, filename)
+			if err != nil {
+				return err
+			}
+			name = filepath.ToSlash(name)
+
+			manifest.Files = append(manifest.Files, name)
+			if opts.Since.IsZero() || info.ModTime().After(cutoff) {
+				changed = append(changed, name)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var gz *gzip.Writer
+
+	if opts.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	tw := tar.NewWriter(w)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.WriteHeader(&tar.Header{Name: backupManifestName, Mode: 0600, Size: int64(len(data)), ModTime: manifest.Time})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range changed {
+		err = addToTar(tw, path.Join(db.path, name), name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if gz != nil {
+		err = gz.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return manifest, nil
+}
+
+//=============================================================================
+// Restore
+//=============================================================================
+
+// Restore materializes a backup written by Backup, gzipped or not, in a
+// database directory, which is created if needed. Restore a full backup into
+// an empty directory, then apply each incremental backup taken after it in
+// order; files deleted between backups are removed from the backed up tables.
+// The database must not be open while it is restored. It takes a reader and
+// the database directory. It returns the backup's manifest and any error
+// encountered.
+func Restore(r io.Reader, dbPath string) (*BackupManifest, error) {
+	var manifest BackupManifest
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupManifestName {
+		return nil, ErrBadBackup
+	}
+
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadBackup, err)
+	}
+
+	err = os.MkdirAll(dbPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !localName(hdr.Name) {
+			return nil, fmt.Errorf("%w: bad file name %q", ErrBadBackup, hdr.Name)
+		}
+
+		err = extractFromTar(tr, hdr, path.Join(dbPath, hdr.Name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &manifest, removeUnlisted(dbPath, &manifest)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// addToTar writes a file to a tar archive under a name.
+func addToTar(tw *tar.Writer, filename string, name string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: info.ModTime()})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+
+	return err
+}
+
+// extractFromTar writes the current entry of a tar archive to a file.
+func extractFromTar(tr *tar.Reader, hdr *tar.Header, filename string) error {
+	err := os.MkdirAll(path.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, tr)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(filename, hdr.ModTime, hdr.ModTime)
+}
+
+// removeUnlisted removes the files of a backup's tables that are not listed in
+// its manifest.
+func removeUnlisted(dbPath string, manifest *BackupManifest) error {
+	listed := make(map[string]bool)
+	for _, name := range manifest.Files {
+		listed[name] = true
+	}
+
+	for _, tblName := range manifest.Tables {
+		if !localName(tblName) {
+			return fmt.Errorf("%w: bad table name %q", ErrBadBackup, tblName)
+		}
+
+		err := filepath.Walk(path.Join(dbPath, tblName), func(filename string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil || info.IsDir() {
+				return err
+			}
+
+			name, err := filepath.Rel(dbPath, filename)
+			if err != nil {
+				return err
+			}
+
+			if !listed[filepath.ToSlash(name)] {
+				return os.Remove(filename)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// localName answers whether a slash separated name stays inside the directory
+// it is relative to.
+func localName(name string) bool {
+	clean := path.Clean(name)
+	return name != "" && !path.IsAbs(clean) && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
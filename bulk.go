@@ -0,0 +1,221 @@
+package ivy
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Type RecordError describes a record that failed to load during a bulk
+// operation. Index is the position of the record in the input, counting from
+// zero, and Id is the id that was allocated to it.
+type RecordError struct {
+	Index int
+	Id    string
+	Err   error
+}
+
+// Type BulkError is returned by bulk operations when one or more records
+// failed. The records that are not listed were written successfully.
+type BulkError struct {
+	Errors []RecordError
+}
+
+func (e *BulkError) Error() string {
+	first := e.Errors[0]
+	return fmt.Sprintf("ivy: %d record(s) failed to load, first at index %d: %v", len(e.Errors), first.Index, first.Err)
+}
+
+// Type BulkLoader streams records into a table. It holds the table's write lock
+// from the moment it is created until Close is called, allocates ids without
+// rescanning the table, writes record files in parallel and rebuilds the
+// table's indexes once at the end. Before-create hooks run in Add and
+// after-create hooks run in Close.
+type BulkLoader struct {
+	db      *DB
+	tblName string
+	gen     IdGenerator
+	nextId  int
+	count   int
+	jobs    chan bulkJob
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	errs    []RecordError
+	created []bulkJob
+	closed  bool
+	unlock  func()
+}
+
+type bulkJob struct {
+	index  int
+	fileId string
+	rec    interface{}
+}
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// CreateMany creates new records for the specified table in one pass.
+// It takes a table name and a slice of structs representing the record data.
+// It returns the ids of the new records, in the same order as the records, and
+// any error encountered. If only some records fail the error is a *BulkError
+// and the ids of the failed records are empty strings.
+func (db *DB) CreateMany(tblName string, recs []interface{}) ([]string, error) {
+	loader, err := db.NewBulkLoader(tblName)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(recs))
+	for i, rec := range recs {
+		ids[i] = loader.Add(rec)
+	}
+
+	err = loader.Close()
+	if bulkErr, ok := err.(*BulkError); ok {
+		for _, recErr := range bulkErr.Errors {
+			ids[recErr.Index] = ""
+		}
+	}
+
+	return ids, err
+}
+
+// NewBulkLoader starts a bulk load into the specified table.
+// It takes a table name. It returns a loader and any error encountered. The
+// table is locked against all other readers and writers until the loader is
+// closed.
+func (db *DB) NewBulkLoader(tblName string) (*BulkLoader, error) {
+	unlock := db.writeLocks(tblName)
+
+	l := &BulkLoader{db: db, tblName: tblName, gen: db.options(tblName).IdGenerator, jobs: make(chan bulkJob), unlock: unlock}
+
+	// Without an IdGenerator, find the next numeric id once and count up from
+	// there.
+	if l.gen == nil {
+		fileId, err := db.nextAvailableFileId(tblName)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+
+		l.nextId, err = strconv.Atoi(fileId)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+
+	workers := runtime.NumCPU()
+	l.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go l.work()
+	}
+
+	return l, nil
+}
+
+//*****************************************************************************
+// Public BulkLoader Methods
+//*****************************************************************************
+
+// Add queues a record to be written. It takes a struct representing the record
+// data. It returns the id allocated to the record, or an empty string if no id
+// could be allocated. Errors are reported by Close, after which Add must not be
+// called.
+func (l *BulkLoader) Add(rec interface{}) string {
+	var fileId string
+
+	index := l.count
+	l.count++
+
+	if l.gen != nil {
+		var err error
+
+		fileId, err = l.db.generateId(l.tblName, l.gen)
+		if err != nil {
+			l.mu.Lock()
+			l.errs = append(l.errs, RecordError{Index: index, Err: err})
+			l.mu.Unlock()
+			return ""
+		}
+	} else {
+		fileId = strconv.Itoa(l.nextId)
+		l.nextId++
+	}
+
+	err := l.db.beforeWrite(l.tblName, fileId, rec, true)
+	if err != nil {
+		l.mu.Lock()
+		l.errs = append(l.errs, RecordError{Index: index, Id: fileId, Err: err})
+		l.mu.Unlock()
+		return ""
+	}
+
+	l.jobs <- bulkJob{index: index, fileId: fileId, rec: rec}
+
+	return fileId
+}
+
+// Close waits for all queued records to be written, rebuilds the table's
+// indexes and releases the table lock. It returns a *BulkError listing the
+// records that failed, or any error encountered rebuilding the indexes.
+func (l *BulkLoader) Close() error {
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	close(l.jobs)
+	l.wg.Wait()
+
+	err := l.db.initTblIndexes(l.tblName)
+
+	l.unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for _, job := range l.created {
+		l.db.afterWrite(l.tblName, job.fileId, job.rec, true)
+	}
+
+	if len(l.errs) > 0 {
+		sort.Slice(l.errs, func(i, j int) bool { return l.errs[i].Index < l.errs[j].Index })
+		return &BulkError{Errors: l.errs}
+	}
+
+	return nil
+}
+
+//*****************************************************************************
+// Private BulkLoader Methods
+//*****************************************************************************
+
+// work writes queued records until the job channel is closed.
+func (l *BulkLoader) work() {
+	defer l.wg.Done()
+
+	for job := range l.jobs {
+		var err error
+
+		// A generator may hand out an id that is already taken.
+		if l.db.recExists(l.tblName, job.fileId) && !l.db.isExpired(l.tblName, job.fileId) {
+			err = ErrExists
+		} else {
+			_, err = l.db.writeRec(l.tblName, job.fileId, job.rec, nil)
+		}
+
+		l.mu.Lock()
+		if err != nil {
+			l.errs = append(l.errs, RecordError{Index: job.index, Id: job.fileId, Err: err})
+		} else if l.db.hasAfterCreate(l.tblName, job.rec) {
+			l.created = append(l.created, job)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,330 @@
+package ivy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Type ProblemKind names a kind of problem found by Check.
+type ProblemKind string
+
+const (
+	// ProblemCorrupt is a record file that fails its checksum or does not
+	// decode to a JSON object. Repair quarantines it.
+	ProblemCorrupt ProblemKind = "corrupt"
+
+	// ProblemSchema is a record that breaks its table's schema.
+	ProblemSchema ProblemKind = "schema"
+
+	// ProblemIndex is a record missing from a field or tag index, or an index
+	// entry for a record that no longer has that value. Repair rebuilds the
+	// table's indexes.
+	ProblemIndex ProblemKind = "index"
+
+	// ProblemTempFile is a temporary file left behind by an interrupted write.
+	// Repair removes it.
+	ProblemTempFile ProblemKind = "temp_file"
+
+	// ProblemBadId is a record whose id is not a valid id, or is not numeric in
+	// a table that allocates ids without an IdGenerator, where it is ignored
+	// when picking the next id.
+	ProblemBadId ProblemKind = "bad_id"
+
+	// ProblemDanglingReference is a reference field holding the id of a record
+	// that does not exist.
+	ProblemDanglingReference ProblemKind = "dangling_reference"
+
+	// ProblemUnreadable is a record that is not corrupt but cannot be read,
+	// such as one whose encrypted fields fail to decrypt. A record encrypted
+	// with a key the database was not opened with is reported as unreadable and
+	// the rest of its table is skipped. The indexes of a table with unreadable
+	// records are not checked.
+	ProblemUnreadable ProblemKind = "unreadable"
+)
+
+// Type Problem is a single problem found by Check. Id is empty for problems
+// that do not concern a record.
+type Problem struct {
+	Table    string      `json:"table"`
+	Id       string      `json:"id,omitempty"`
+	Kind     ProblemKind `json:"kind"`
+	Detail   string      `json:"detail"`
+	Repaired bool        `json:"repaired"`
+}
+
+// Type CheckReport is the result of Check or Repair. It marshals to JSON for
+// tools that consume it.
+type CheckReport struct {
+	Tables   int       `json:"tables"`
+	Records  int       `json:"records"`
+	Problems []Problem `json:"problems"`
+}
+
+// CheckPath opens the database at a path, checks it like Check, or repairs it
+// like Repair if repair is set, and closes it again. It takes the same
+// arguments as OpenDBWithOptions plus the repair flag. Unlike opening the
+// database and calling Check, it works on databases whose indexes cannot be
+// built because of corrupt records: each table's indexes are only built and
+// checked once its corrupt records have been quarantined, or if it has none.
+// It returns a report of the problems found and any error encountered.
+func CheckPath(dbPath string, fieldsToIndex map[string][]string, tblOptions map[string]*TableOptions, repair bool) (*CheckReport, error) {
+	db, err := openDB(dbPath, fieldsToIndex, tblOptions, false)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return db.check(repair)
+}
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// Check walks every table of the database looking for corrupt records,
+// records that break their schema, indexes that disagree with the records on
+// disk, leftover temporary files, bad ids and dangling references. Records
+// that cannot be read are reported rather than stopping the check. Each table
+// is read locked while it is checked. It returns a report of the problems
+// found and any error that stopped the check.
+func (db *DB) Check() (*CheckReport, error) {
+	return db.check(false)
+}
+
+// Repair checks the database like Check and fixes the problems it safely can:
+// it quarantines corrupt records, removes temporary files and rebuilds
+// indexes. Schema violations, bad ids and dangling references are only
+// reported. Each table is write locked while it is repaired. It returns a
+// report of the problems found, marking those repaired, and any error that
+// stopped the repair.
+func (db *DB) Repair() (*CheckReport, error) {
+	return db.check(true)
+}
+
+//*****************************************************************************
+// Public CheckReport Methods
+//*****************************************************************************
+
+// OK answers whether every problem in the report was repaired.
+func (r *CheckReport) OK() bool {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// check checks, and optionally repairs, every table of the database.
+func (db *DB) check(repair bool) (*CheckReport, error) {
+	var tblNames []string
+
+	report := &CheckReport{Problems: []Problem{}}
+
+	for tblName := range db.rwLocks {
+		tblNames = append(tblNames, tblName)
+	}
+	sort.Strings(tblNames)
+
+	for _, tblName := range tblNames {
+		err := db.checkTbl(report, tblName, repair)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// checkTbl checks a single table, adding the problems it finds to a report.
+func (db *DB) checkTbl(report *CheckReport, tblName string, repair bool) error {
+	var readTbls []string
+	var unlock func()
+
+	opts := db.options(tblName)
+
+	for _, ref := range opts.References {
+		readTbls = append(readTbls, ref.Table)
+	}
+
+	if repair {
+		unlock = db.lockTbls([]string{tblName}, readTbls)
+	} else {
+		unlock = db.lockTbls(nil, append(readTbls, tblName))
+	}
+	defer unlock()
+
+	report.Tables++
+
+	add := func(fileId string, kind ProblemKind, detail string, repaired bool) {
+		report.Problems = append(report.Problems, Problem{Table: tblName, Id: fileId, Kind: kind, Detail: detail, Repaired: repaired})
+	}
+
+	files, _ := ioutil.ReadDir(db.tblPath(tblName))
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".tmp") {
+			repaired := repair && os.Remove(path.Join(db.tblPath(tblName), file.Name())) == nil
+			add("", ProblemTempFile, file.Name(), repaired)
+		}
+	}
+
+	recs := make(map[string]map[string]interface{})
+	quarantined := false
+	corrupt := false
+	unreadable := false
+
+	for _, fileId := range db.fileIdsInDataDir(tblName) {
+		report.Records++
+
+		if !validFileId(fileId) {
+			add(fileId, ProblemBadId, "not a valid record id", false)
+		} else if _, err := strconv.Atoi(fileId); err != nil && opts.IdGenerator == nil {
+			add(fileId, ProblemBadId, "non-numeric id in a table without an IdGenerator", false)
+		}
+
+		data, err := db.readSealedRec(tblName, fileId)
+		if errors.Is(err, ErrCorrupt) {
+			repaired := repair && db.quarantine(tblName, fileId, err) == nil
+			quarantined = quarantined || repaired
+			corrupt = corrupt || !repaired
+			add(fileId, ProblemCorrupt, err.Error(), repaired)
+			continue
+		}
+		if errors.Is(err, ErrKeyNotFound) {
+			add(fileId, ProblemUnreadable, fmt.Sprintf("%v; the rest of the table was skipped", err), false)
+			return nil
+		}
+
+		var rec map[string]interface{}
+
+		if err == nil {
+			data, err = db.openFields(tblName, data)
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &rec)
+		}
+		if err != nil {
+			unreadable = true
+			add(fileId, ProblemUnreadable, err.Error(), false)
+			continue
+		}
+		recs[fileId] = rec
+
+		if err := db.validateRec(tblName, rec); err != nil {
+			add(fileId, ProblemSchema, err.Error(), false)
+		}
+
+		for _, ref := range opts.References {
+			for _, refId := range refIds(rec[ref.Field]) {
+				if !validFileId(refId) || !db.recExists(ref.Table, refId) {
+					add(fileId, ProblemDanglingReference, fmt.Sprintf("field %s references missing %s record %q", ref.Field, ref.Table, refId), false)
+				}
+			}
+		}
+	}
+
+	// Without every record, the indexes cannot be built or compared.
+	if unreadable {
+		return nil
+	}
+
+	// The indexes of a table opened by CheckPath are built now, unless corrupt
+	// records are still in the way. Being fresh, they match the records.
+	if db.unindexed[tblName] {
+		if corrupt {
+			return nil
+		}
+
+		delete(db.unindexed, tblName)
+
+		return db.initTblIndexes(tblName)
+	}
+
+	indexProblems := db.checkIndexes(tblName, recs)
+
+	if repair && (len(indexProblems) > 0 || quarantined) {
+		err := db.initTblIndexes(tblName)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range indexProblems {
+		add(p.Id, ProblemIndex, p.Detail, repair)
+	}
+
+	return nil
+}
+
+// checkIndexes compares the field and tag indexes of a table with the records
+// read from disk. It returns the differences found, sorted by record id.
+func (db *DB) checkIndexes(tblName string, recs map[string]map[string]interface{}) []Problem {
+	var problems []Problem
+
+	for _, fldName := range db.fieldsToIndex[tblName] {
+		var index map[string][]string
+
+		expected := make(map[string]map[string]bool)
+
+		if fldName == "tags" {
+			index = db.tagIndexes[tblName]
+			for fileId, rec := range recs {
+				for _, tag := range stringsOf(rec["tags"]) {
+					if expected[tag] == nil {
+						expected[tag] = make(map[string]bool)
+					}
+					expected[tag][fileId] = true
+				}
+			}
+		} else if db.indexedField(tblName, fldName) {
+			index = db.fldIndexes[tblName][fldName]
+			for fileId, rec := range recs {
+				if value, ok := rec[fldName].(string); ok {
+					key := db.indexKey(tblName, fldName, value)
+					if expected[key] == nil {
+						expected[key] = make(map[string]bool)
+					}
+					expected[key][fileId] = true
+				}
+			}
+		} else {
+			continue
+		}
+
+		for key, fileIds := range expected {
+			for fileId := range fileIds {
+				if !stringInSlice(fileId, index[key]) {
+					problems = append(problems, Problem{Id: fileId, Detail: fmt.Sprintf("record is missing from the %s index", fldName)})
+				}
+			}
+		}
+
+		for key, fileIds := range index {
+			for _, fileId := range fileIds {
+				if !expected[key][fileId] {
+					problems = append(problems, Problem{Id: fileId, Detail: fmt.Sprintf("stale entry in the %s index", fldName)})
+				}
+			}
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Id != problems[j].Id {
+			return problems[i].Id < problems[j].Id
+		}
+		return problems[i].Detail < problems[j].Detail
+	})
+
+	return problems
+}
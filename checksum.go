@@ -0,0 +1,167 @@
+package ivy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// ErrCorrupt is returned when a record file fails its checksum or cannot be
+// decoded.
+var ErrCorrupt = errors.New("ivy: record is corrupt")
+
+// Type CorruptRecord describes a record that was moved out of its table
+// because it was corrupt.
+type CorruptRecord struct {
+	Id     string
+	Reason string
+	Time   time.Time
+}
+
+// corruptDir is the name of the directory, inside a table directory, that
+// corrupt records are quarantined in.
+const corruptDir = "_corrupt"
+
+// checksumMagic starts every checksummed file, followed by the CRC-32C of the
+// rest of the file as a big endian uint32.
+var checksumMagic = []byte("\x00IVC")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// CorruptRecords lists the records of a table that have been quarantined.
+// It takes a table name. It returns the quarantined records and any error
+// encountered. The files themselves are kept in the table's _corrupt
+// directory for inspection; put a repaired file back in the table directory
+// and reopen the database to restore a record.
+func (db *DB) CorruptRecords(tblName string) ([]CorruptRecord, error) {
+	var recs []CorruptRecord
+
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	dir := db.corruptPath(tblName)
+	ext := db.codec(tblName).Ext()
+
+	for _, fileId := range fileIdsInDir(dir, ext) {
+		rec := CorruptRecord{Id: fileId}
+
+		if info, err := os.Stat(path.Join(dir, fileId+ext)); err == nil {
+			rec.Time = info.ModTime()
+		}
+		if reason, err := ioutil.ReadFile(path.Join(dir, fileId+".reason")); err == nil {
+			rec.Reason = string(reason)
+		}
+
+		recs = append(recs, rec)
+	}
+
+	return recs, nil
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// checksum prefixes stored data with its checksum, if the table keeps
+// checksums.
+func (db *DB) checksum(tblName string, data []byte) []byte {
+	if !db.options(tblName).Checksums {
+		return data
+	}
+	return addChecksum(data)
+}
+
+// quarantineCorrupt moves the corrupt records of a table into its _corrupt
+// directory, so the rest of the table stays usable. The caller must hold the
+// table's write lock.
+func (db *DB) quarantineCorrupt(tblName string) error {
+	for _, fileId := range db.fileIdsInDataDir(tblName) {
+		_, err := db.readSealedRec(tblName, fileId)
+		if !errors.Is(err, ErrCorrupt) {
+			continue
+		}
+
+		err = db.quarantine(tblName, fileId, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// quarantine moves a record file into the table's _corrupt directory, next to
+// a file giving the reason.
+func (db *DB) quarantine(tblName string, fileId string, reason error) error {
+	dir := db.corruptPath(tblName)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	quarantined := path.Join(dir, fileId+db.codec(tblName).Ext())
+
+	err = db.store(tblName).moveOut(fileId, quarantined)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	err = os.Chtimes(quarantined, now, now)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(dir, fileId+".reason"), []byte(reason.Error()), 0600)
+}
+
+// corruptPath returns the quarantine directory of a table.
+func (db *DB) corruptPath(tblName string) string {
+	return path.Join(db.tblPath(tblName), corruptDir)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// addChecksum prefixes data with its checksum.
+func addChecksum(data []byte) []byte {
+	sum := make([]byte, len(checksumMagic)+4, len(checksumMagic)+4+len(data))
+	copy(sum, checksumMagic)
+	binary.BigEndian.PutUint32(sum[len(checksumMagic):], crc32.Checksum(data, crc32c))
+
+	return append(sum, data...)
+}
+
+// verifyChecksum checks the checksum of stored data and strips it. Data
+// without a checksum is returned as it is.
+func verifyChecksum(stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, checksumMagic) {
+		return stored, nil
+	}
+
+	if len(stored) < len(checksumMagic)+4 {
+		return nil, errors.New("ivy: checksum is truncated")
+	}
+
+	want := binary.BigEndian.Uint32(stored[len(checksumMagic):])
+	data := stored[len(checksumMagic)+4:]
+
+	if got := crc32.Checksum(data, crc32c); got != want {
+		return nil, fmt.Errorf("ivy: checksum mismatch: stored %08x, computed %08x", want, got)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,311 @@
+package ivy
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Type Codec decides how records are stored on disk. Pick one per table with
+// TableOptions.Codec; tables without one store compact JSON, as Ivy always has.
+//
+// A codec works on the JSON form of a record: Encode turns a marshalled record
+// into the bytes written to its file and Decode turns them back into JSON, so
+// the rest of Ivy (indexes, schemas, patches, history) sees JSON whatever the
+// codec. Record files are named <id><Ext>.
+type Codec interface {
+	// Ext returns the file extension of records stored with the codec,
+	// including the leading dot.
+	Ext() string
+
+	// Encode converts a marshalled JSON record into its stored form.
+	Encode(data []byte) ([]byte, error)
+
+	// Decode converts a stored record back into JSON.
+	Decode(data []byte) ([]byte, error)
+}
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// MigrateCodec rewrites the records of a table that were stored with another
+// codec using the table's current codec. Change TableOptions.Codec, open the
+// database and call MigrateCodec with the codec the table used before.
+// It takes a table name and the previous codec. It returns the number of
+// records rewritten and any error encountered. Live records that already use
+// the current codec's file extension are left alone, unless the previous codec
+// has the same extension.
+func (db *DB) MigrateCodec(tblName string, from Codec) (int, error) {
+	migrated := 0
+
+	db.rwLocks[tblName].Lock()
+	defer db.rwLocks[tblName].Unlock()
+
+	live := recStore(fileStore{dir: db.tblPath(tblName), ext: from.Ext()})
+	if seg, ok := db.segments[tblName]; ok {
+		// Segment entries do not record their codec, so the whole table is
+		// migrated.
+		live = seg
+	}
+
+	n, err := db.migrateStore(tblName, live, db.store(tblName), from)
+	migrated += n
+	if err != nil {
+		return migrated, err
+	}
+
+	// Soft deleted records are migrated too, so they can still be restored.
+	n, err = db.migrateStore(tblName, fileStore{dir: db.trashPath(tblName), ext: from.Ext()}, db.trashStore(tblName), from)
+	migrated += n
+	if err != nil {
+		return migrated, err
+	}
+
+	return migrated, db.initTblIndexes(tblName)
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// codec returns the codec of a table.
+func (db *DB) codec(tblName string) Codec {
+	if codec := db.options(tblName).Codec; codec != nil {
+		return codec
+	}
+	return jsonCodec{}
+}
+
+// migrateStore rewrites the records in a store of a table from another codec
+// to the table's codec, moving them to another store, which may be the same
+// one. It returns the number of records rewritten and any error encountered.
+func (db *DB) migrateStore(tblName string, src recStore, dst recStore, from Codec) (int, error) {
+	migrated := 0
+	to := db.codec(tblName)
+
+	for _, fileId := range src.ids() {
+		stored, err := src.read(fileId)
+		if err != nil {
+			return migrated, err
+		}
+
+		encoded, err := db.unseal(tblName, stored)
+		if err != nil {
+			return migrated, fmt.Errorf("ivy: cannot unseal record %s: %v", fileId, err)
+		}
+
+		data, err := from.Decode(encoded)
+		if err != nil {
+			return migrated, fmt.Errorf("ivy: cannot decode record %s: %v", fileId, err)
+		}
+
+		encoded, err = to.Encode(data)
+		if err != nil {
+			return migrated, err
+		}
+
+		stored, err = db.seal(tblName, encoded)
+		if err != nil {
+			return migrated, err
+		}
+
+		err = dst.write(fileId, stored)
+		if err != nil {
+			return migrated, err
+		}
+
+		if src != dst {
+			err = src.remove(fileId)
+			if err != nil {
+				return migrated, err
+			}
+		}
+
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+//=============================================================================
+// JSON
+//=============================================================================
+
+// NewJSONCodec returns a codec that stores records as compact JSON in .json
+// files. It is the default.
+func NewJSONCodec() Codec {
+	return jsonCodec{}
+}
+
+// NewPrettyJSONCodec returns a codec that stores records as indented JSON in
+// .json files, for tables that people read and edit by hand.
+func NewPrettyJSONCodec() Codec {
+	return jsonCodec{pretty: true}
+}
+
+type jsonCodec struct {
+	pretty bool
+}
+
+func (c jsonCodec) Ext() string {
+	return ".json"
+}
+
+func (c jsonCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if c.pretty {
+		err := json.Indent(&buf, data, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte('\n')
+	} else {
+		err := json.Compact(&buf, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c jsonCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+//=============================================================================
+// Gob
+//=============================================================================
+
+// NewGobCodec returns a codec that stores records in Go's gob format in .gob
+// files. Numbers are kept exactly as they appear in the JSON.
+func NewGobCodec() Codec {
+	return gobCodec{}
+}
+
+type gobCodec struct{}
+
+// gobValue is a decoded JSON value in a form gob can encode, since gob cannot
+// encode the nil values of a map[string]interface{}.
+type gobValue struct {
+	Kind byte // one of the gob kinds below
+	Str  string
+	Bool bool
+	Arr  []gobValue
+	Obj  map[string]gobValue
+}
+
+// The kinds of gobValue. Numbers keep their JSON text in Str.
+const (
+	gobNull byte = iota
+	gobBool
+	gobNumber
+	gobString
+	gobArray
+	gobObject
+)
+
+func (c gobCodec) Ext() string {
+	return ".gob"
+}
+
+func (c gobCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	v, err := decodeJSONNumbers(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gob.NewEncoder(&buf).Encode(toGobValue(v))
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c gobCodec) Decode(data []byte) ([]byte, error) {
+	var gv gobValue
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&gv)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fromGobValue(gv))
+}
+
+// toGobValue converts a decoded JSON value into a gobValue.
+func toGobValue(v interface{}) gobValue {
+	switch t := v.(type) {
+	case bool:
+		return gobValue{Kind: gobBool, Bool: t}
+	case json.Number:
+		return gobValue{Kind: gobNumber, Str: t.String()}
+	case string:
+		return gobValue{Kind: gobString, Str: t}
+	case []interface{}:
+		arr := make([]gobValue, len(t))
+		for i, x := range t {
+			arr[i] = toGobValue(x)
+		}
+		return gobValue{Kind: gobArray, Arr: arr}
+	case map[string]interface{}:
+		obj := make(map[string]gobValue, len(t))
+		for k, x := range t {
+			obj[k] = toGobValue(x)
+		}
+		return gobValue{Kind: gobObject, Obj: obj}
+	default:
+		return gobValue{Kind: gobNull}
+	}
+}
+
+// fromGobValue converts a gobValue back into a JSON value.
+func fromGobValue(gv gobValue) interface{} {
+	switch gv.Kind {
+	case gobBool:
+		return gv.Bool
+	case gobNumber:
+		return json.Number(gv.Str)
+	case gobString:
+		return gv.Str
+	case gobArray:
+		arr := make([]interface{}, len(gv.Arr))
+		for i, x := range gv.Arr {
+			arr[i] = fromGobValue(x)
+		}
+		return arr
+	case gobObject:
+		obj := make(map[string]interface{}, len(gv.Obj))
+		for k, x := range gv.Obj {
+			obj[k] = fromGobValue(x)
+		}
+		return obj
+	default:
+		return nil
+	}
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// decodeJSONNumbers decodes a JSON value, keeping numbers as json.Number.
+func decodeJSONNumbers(data []byte) (interface{}, error) {
+	var v interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
@@ -0,0 +1,184 @@
+package ivy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Type CompressionAlgorithm names a standard library compression format.
+type CompressionAlgorithm byte
+
+const (
+	Gzip CompressionAlgorithm = iota + 1
+	Zlib
+	Flate
+)
+
+// Type Compression holds the compression settings of a table. Records whose
+// stored form is at least Threshold bytes long are compressed with Algorithm
+// at Level, one of the compress/flate levels; zero means the default level.
+// Compressed files start with a short header, so a table can hold compressed
+// and uncompressed records side by side and records are always read back
+// whatever the table's current settings.
+type Compression struct {
+	Algorithm CompressionAlgorithm
+	Level     int
+	Threshold int
+}
+
+// compressMagic starts every compressed record file, followed by one byte
+// naming the algorithm. No codec writes a record starting with a zero byte.
+var compressMagic = []byte("\x00IVZ")
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// CompressTable rewrites every record of a table, including soft deleted
+// ones, to match the table's current compression settings: compressing the
+// records that should be compressed and decompressing the rest. To decompress
+// a whole table, remove its Compression option and call CompressTable.
+// It takes a table name. It returns the number of records rewritten and any
+// error encountered.
+func (db *DB) CompressTable(tblName string) (int, error) {
+	rewritten := 0
+
+	db.rwLocks[tblName].Lock()
+	defer db.rwLocks[tblName].Unlock()
+
+	for _, st := range []recStore{db.store(tblName), db.trashStore(tblName)} {
+		for _, fileId := range st.ids() {
+			stored, err := st.read(fileId)
+			if err != nil {
+				return rewritten, err
+			}
+
+			encrypted, err := verifyChecksum(stored)
+			if err != nil {
+				return rewritten, fmt.Errorf("%w: %s/%s: %v", ErrCorrupt, tblName, fileId, err)
+			}
+
+			compressed, err := db.decrypt(tblName, encrypted)
+			if err != nil {
+				return rewritten, err
+			}
+
+			plain, err := decompress(compressed)
+			if err != nil {
+				return rewritten, fmt.Errorf("ivy: cannot decompress record %s: %v", fileId, err)
+			}
+
+			recompressed, err := db.compress(tblName, plain)
+			if err != nil {
+				return rewritten, err
+			}
+
+			if bytes.Equal(recompressed, compressed) {
+				continue
+			}
+
+			stored, err = db.encrypt(tblName, recompressed)
+			if err != nil {
+				return rewritten, err
+			}
+
+			err = st.write(fileId, db.checksum(tblName, stored))
+			if err != nil {
+				return rewritten, err
+			}
+			rewritten++
+		}
+	}
+
+	return rewritten, nil
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// compress compresses an encoded record if the table's settings call for it.
+// It returns the bytes to store and any error encountered.
+func (db *DB) compress(tblName string, data []byte) ([]byte, error) {
+	c := db.options(tblName).Compression
+	if c == nil || len(data) < c.Threshold {
+		return data, nil
+	}
+
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	buf.Write(compressMagic)
+	buf.WriteByte(byte(c.Algorithm))
+
+	switch c.Algorithm {
+	case Gzip:
+		w, err = gzip.NewWriterLevel(&buf, level)
+	case Zlib:
+		w, err = zlib.NewWriterLevel(&buf, level)
+	case Flate:
+		w, err = flate.NewWriter(&buf, level)
+	default:
+		err = fmt.Errorf("ivy: unknown compression algorithm %d", c.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// decompress returns the encoded record held in a stored record, which is the
+// stored record itself if it is not compressed.
+func decompress(stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, compressMagic) || len(stored) <= len(compressMagic) {
+		return stored, nil
+	}
+
+	var r io.ReadCloser
+	var err error
+
+	body := bytes.NewReader(stored[len(compressMagic)+1:])
+
+	switch CompressionAlgorithm(stored[len(compressMagic)]) {
+	case Gzip:
+		r, err = gzip.NewReader(body)
+	case Zlib:
+		r, err = zlib.NewReader(body)
+	case Flate:
+		r = flate.NewReader(body)
+	default:
+		err = fmt.Errorf("ivy: unknown compression algorithm %d", stored[len(compressMagic)])
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
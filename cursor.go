@@ -0,0 +1,226 @@
+package ivy
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+)
+
+// scanBatchSize is the number of directory entries a Cursor reads at a time.
+const scanBatchSize = 256
+
+// Type ScanOptions holds the optional settings for Scan. Snapshot holds the
+// table's read lock from the call to Scan until the cursor is closed, so the
+// scan sees the table exactly as it was when it began; writers to the table
+// wait until then. Read locks are not reentrant, so a snapshot scan must not
+// call other DB methods on the same table before it is closed: once a writer
+// is waiting, a Find on the table would deadlock. Use Decode, or gather the ids
+// and load them after Close. Without Snapshot the lock is only held while each
+// record is read, so records written during the scan may or may not be seen.
+// Projection, when set, makes Decode load only the fields it selects.
+type ScanOptions struct {
+	Snapshot   bool
+	Projection *Projection
+}
+
+// Type Cursor streams the records of a table one at a time, reading the table
+// directory in batches so that memory use does not grow with the table. Use it
+// like a bufio.Scanner:
+//
+//	cur, err := db.Scan("planes", nil)
+//	...
+//	defer cur.Close()
+//	for cur.Next() {
+//		plane := Plane{}
+//		err := cur.Decode(&plane)
+//		...
+//	}
+//	err = cur.Err()
+//
+// Records are visited in directory order. Tables using segment storage list
+// their ids up front instead, in id order. A Cursor must not be shared between
+// goroutines.
+type Cursor struct {
+	db       *DB
+	tblName  string
+	snapshot bool
+	proj     *Projection
+	dir      *os.File
+	batch    []string
+	fileId   string
+	data     []byte
+	err      error
+	closed   bool
+}
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// Scan starts a streaming scan of the records of a table.
+// It takes a table name and options, which may be nil. It returns a cursor
+// positioned before the first record and any error encountered. The cursor
+// must be closed, which stopping early does not do by itself.
+func (db *DB) Scan(tblName string, opts *ScanOptions) (*Cursor, error) {
+	if opts == nil {
+		opts = &ScanOptions{}
+	}
+
+	c := &Cursor{db: db, tblName: tblName, snapshot: opts.Snapshot, proj: opts.Projection}
+
+	if c.snapshot {
+		db.rwLocks[tblName].RLock()
+	}
+
+	if seg, ok := db.segments[tblName]; ok {
+		if !c.snapshot {
+			db.rwLocks[tblName].RLock()
+			defer db.rwLocks[tblName].RUnlock()
+		}
+		c.batch = seg.ids()
+		return c, nil
+	}
+
+	dir, err := os.Open(db.tblPath(tblName))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.dir = dir
+
+	return c, nil
+}
+
+//*****************************************************************************
+// Public Cursor Methods
+//*****************************************************************************
+
+// Next moves the cursor to the next live record. It returns false when there
+// are no more records or an error occurred, which Err reports.
+func (c *Cursor) Next() bool {
+	for !c.closed && c.err == nil {
+		if len(c.batch) == 0 {
+			if c.dir == nil {
+				c.Close()
+				return false
+			}
+
+			names, err := c.dir.Readdirnames(scanBatchSize)
+			if err == io.EOF {
+				c.Close()
+				return false
+			}
+			if err != nil {
+				c.err = err
+				return false
+			}
+
+			ext := c.db.codec(c.tblName).Ext()
+			for _, name := range names {
+				if path.Ext(name) == ext {
+					c.batch = append(c.batch, name[:len(name)-len(ext)])
+				}
+			}
+			continue
+		}
+
+		fileId := c.batch[0]
+		c.batch = c.batch[1:]
+
+		data, err := c.read(fileId)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			c.err = err
+			return false
+		}
+		if data == nil {
+			continue
+		}
+
+		c.fileId, c.data = fileId, data
+
+		return true
+	}
+
+	return false
+}
+
+// Id returns the id of the current record.
+func (c *Cursor) Id() string {
+	return c.fileId
+}
+
+// Decode decodes the current record, or the fields selected by the scan's
+// projection, into the supplied interface. If it is a Record, its AfterFind
+// method is run as it would be by Find. It returns any error encountered.
+func (c *Cursor) Decode(rec interface{}) error {
+	data := c.data
+
+	if c.proj != nil {
+		doc, err := c.proj.apply(data)
+		if err != nil {
+			return err
+		}
+
+		data, err = json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := json.Unmarshal(data, rec)
+	if err != nil {
+		return err
+	}
+
+	if r, ok := rec.(Record); ok {
+		r.AfterFind(c.db, c.fileId)
+	}
+
+	return nil
+}
+
+// Err returns the first error the cursor met, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close ends the scan, releasing the table's read lock for snapshot scans.
+// It is safe to call more than once. It returns any error encountered.
+func (c *Cursor) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	if c.snapshot {
+		c.db.rwLocks[c.tblName].RUnlock()
+	}
+
+	if c.dir != nil {
+		return c.dir.Close()
+	}
+
+	return nil
+}
+
+//*****************************************************************************
+// Private Cursor Methods
+//*****************************************************************************
+
+// read returns a record as JSON, or nil if the record has expired.
+func (c *Cursor) read(fileId string) ([]byte, error) {
+	if !c.snapshot {
+		c.db.rwLocks[c.tblName].RLock()
+		defer c.db.rwLocks[c.tblName].RUnlock()
+	}
+
+	if c.db.isExpired(c.tblName, fileId) {
+		return nil, nil
+	}
+
+	return c.db.readRecData(c.tblName, fileId)
+}
@@ -3,14 +3,48 @@
 package ivy
 
 import (
+	"compress/flate"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
+)
+
+var (
+	// ErrExists is returned by Insert when a record with the id already exists.
+	ErrExists = errors.New("ivy: record already exists")
+
+	// ErrNotFound is returned by Replace when there is no record with the id.
+	ErrNotFound = errors.New("ivy: record not found")
+
+	// ErrInvalidId is returned when a record id is empty or is not a plain file
+	// name.
+	ErrInvalidId = errors.New("ivy: invalid record id")
+)
+
+// errUnchanged is returned by a mutateRec function to skip the write when the
+// record did not need to change.
+var errUnchanged = errors.New("ivy: record unchanged")
+
+// The fields Ivy maintains in tables with TableOptions.Timestamps set.
+const (
+	CreatedAtField = "created_at"
+	UpdatedAtField = "updated_at"
+)
+
+// Write modes for put.
+const (
+	putAny     = iota // create or silently overwrite
+	putInsert         // fail with ErrExists if the record exists
+	putReplace        // fail with ErrNotFound if the record is missing
 )
 
 // Type Record is an interface that your table model needs to implement.
@@ -24,50 +58,123 @@ type Record interface {
 	AfterFind(*DB, string)
 }
 
+// Type TableOptions holds the optional settings for a single table. Pass them
+// to OpenDBWithOptions in a map keyed by table name.
+type TableOptions struct {
+	// VectorIndexes lists the numeric array fields to build vector indexes for.
+	VectorIndexes []VectorIndex
+
+	// GeoIndexes lists the points to build geospatial indexes for.
+	GeoIndexes []GeoIndex
+
+	// IdGenerator allocates the ids of records created without one. When nil,
+	// new records get one more than the highest numeric id in the table.
+	IdGenerator IdGenerator
+
+	// Schema, when set, is checked against every record written to the table.
+	Schema *Schema
+
+	// Hooks are run around every write to the table.
+	Hooks *Hooks
+
+	// Timestamps makes Ivy keep the created_at and updated_at fields of every
+	// record in the table, as RFC 3339 UTC times.
+	Timestamps bool
+
+	// SoftDelete makes Delete move records to the table's trash instead of
+	// removing them. Trashed records are hidden from every lookup but can be
+	// brought back with Restore until they are purged.
+	SoftDelete bool
+
+	// History makes Ivy keep every revision of the table's records, so they can
+	// be read back with History, FindAtRevision and FindAsOf. HistoryLimit caps
+	// the number of revisions kept per record and HistoryMaxAge drops revisions
+	// older than a duration; zero means no limit. The newest revision of a
+	// record is always kept.
+	History       bool
+	HistoryLimit  int
+	HistoryMaxAge time.Duration
+
+	// TTL makes every record in the table expire this long after it was last
+	// written. Expiring makes the table track per-record expiry times set with
+	// Expire, and is implied by a non-zero TTL. Expired records disappear from
+	// every lookup at once and are removed from disk by a background reaper.
+	TTL      time.Duration
+	Expiring bool
+
+	// ReapInterval is how often the background reaper runs for the table;
+	// zero means once a minute. OnReapError is called with any error the
+	// reaper runs into; when nil, errors are written to the standard logger.
+	ReapInterval time.Duration
+	OnReapError  func(tblName string, err error)
+
+	// References declares the fields of the table that hold ids of records in
+	// other tables, and what happens to the table's records when the records
+	// they reference are deleted.
+	References []Reference
+
+	// Codec decides how the table's records are stored on disk. When nil,
+	// records are stored as compact JSON.
+	Codec Codec
+
+	// Compression, when set, compresses the table's larger records on disk.
+	Compression *Compression
+
+	// Encryption, when set, encrypts the table's record files and history with
+	// AES-GCM, using keys from the provider. Records are decrypted as they are
+	// read, so indexes work as they do for plaintext tables.
+	Encryption KeyProvider
+
+	// FieldEncryption, when set, encrypts some fields of the table's records
+	// while leaving the rest readable.
+	FieldEncryption *FieldEncryption
+
+	// Checksums stores a CRC-32C checksum in every record file of the table,
+	// which is verified whenever the record is read.
+	Checksums bool
+
+	// QuarantineCorrupt makes Ivy move records that fail their checksum or
+	// cannot be decoded into the table's _corrupt directory whenever the
+	// table's indexes are built, instead of failing. CorruptRecords lists them.
+	QuarantineCorrupt bool
+
+	// Segments, when set, stores the table's records in large append-only
+	// segment files instead of one file per record.
+	Segments *SegmentOptions
+}
+
 // Type DB is a struct representing the database connection.
 type DB struct {
 	path          string
 	rwLocks       map[string]*sync.RWMutex
 	fieldsToIndex map[string][]string
+	tblOptions    map[string]*TableOptions
 	tagIndexes    map[string]map[string][]string // I don't actually care about this
 	fldIndexes    map[string]map[string]map[string][]string
+	fldValues     map[string]map[string]map[string]string
+	fuzzyIndexes  map[string]map[string]*bkTree
+	vecIndexes    map[string]map[string]*vectorIndex
+	geoIndexes    map[string]map[string]*geoIndex
+	refIndexes    map[string]map[string]map[string][]string
+	segments      map[string]*segmentStore
+	unindexed     map[string]bool
+	expiries      map[string]map[string]time.Time
+	expiryMu      sync.Mutex
+	stopReaper    chan struct{}
+	reaperDone    chan struct{}
 }
 
 // OpenDB initializes an ivy database.
 // It returns a pointer to a DB struct and any error encountered.
 func OpenDB(dbPath string, fieldsToIndex map[string][]string) (*DB, error) {
-	db := new(DB)
-	db.path = dbPath
-	db.fieldsToIndex = fieldsToIndex
-
-	err := db.performChecks()
-	if err != nil {
-		return nil, err
-	}
-
-	db.rwLocks = make(map[string]*sync.RWMutex)
-
-	db.tagIndexes = make(map[string]map[string][]string) // I don't actually care about this
-	db.fldIndexes = make(map[string]map[string]map[string][]string)
-
-	files, _ := ioutil.ReadDir(db.path)
-
-	for _, file := range files {
-		if file.IsDir() {
-			if file.Name() != "." && file.Name() != ".." {
-				db.rwLocks[file.Name()] = new(sync.RWMutex)
-			}
-		}
-	}
-
-	for tblName := range db.fieldsToIndex {
-		err := db.initTblIndexes(tblName)
-		if err != nil {
-			return nil, err
-		}
-	}
+	return OpenDBWithOptions(dbPath, fieldsToIndex, nil)
+}
 
-	return db, nil
+// OpenDBWithOptions initializes an ivy database with per-table options.
+// It takes the same arguments as OpenDB plus a map of table names to options.
+// It returns a pointer to a DB struct and any error encountered.
+func OpenDBWithOptions(dbPath string, fieldsToIndex map[string][]string, tblOptions map[string]*TableOptions) (*DB, error) {
+	return openDB(dbPath, fieldsToIndex, tblOptions, true)
 }
 
 //*****************************************************************************
@@ -82,6 +189,10 @@ func (db *DB) Find(tblName string, rec Record, fileId string) error {
 	db.rwLocks[tblName].RLock()
 	defer db.rwLocks[tblName].RUnlock()
 
+	if db.isExpired(tblName, fileId) {
+		return db.notFoundErr(tblName, fileId)
+	}
+
 	err := db.loadRec(tblName, rec, fileId)
 	if err != nil {
 		return err
@@ -106,7 +217,7 @@ func (db *DB) FindAllIds(tblName string) ([]string, error) {
 		ids = append(ids, fileId)
 	}
 
-	return ids, nil
+	return db.liveIds(tblName, ids), nil
 }
 
 // FindFirstIdForField returns the first record id that matches the supplied
@@ -125,37 +236,29 @@ func (db *DB) FindFirstIdForField(tblName string, searchField string, searchValu
 // criteria.  It takes a table name, a field name to search on, and a value
 // to search for.  It returns a slice of record ids and any error encountered.
 func (db *DB) FindAllIdsForField(tblName string, searchField string, searchValue string) ([]string, error) {
-	var rec map[string]interface{}
 	var ids []string
 
 	db.rwLocks[tblName].RLock()
 	defer db.rwLocks[tblName].RUnlock()
 
 	// If we have an index on that field...
-	if ids, ok := db.fldIndexes[tblName][searchField][searchValue]; ok {
-		return ids, nil
+	if ids, ok := db.fldIndexes[tblName][searchField][db.indexKey(tblName, searchField, searchValue)]; ok {
+		return db.liveIds(tblName, ids), nil
 	}
 
 	// Otherwise, for every file in the data dir...
 	for _, fileId := range db.fileIdsInDataDir(tblName) {
-		filename := db.filePath(tblName, fileId)
-
-		data, err := ioutil.ReadFile(filename)
+		rec, err := db.loadRecMap(tblName, fileId)
 		if err != nil {
 			return nil, err
 		}
 
-		err = json.Unmarshal(data, &rec)
-		if err != nil {
-			return nil, err
-		}
-
-		if rec[searchField].(string) == searchValue {
+		if fldValue, ok := rec[searchField].(string); ok && fldValue == searchValue {
 			ids = append(ids, fileId)
 		}
 	}
 
-	return ids, nil
+	return db.liveIds(tblName, ids), nil
 }
 
 /* I don't actually care about this */
@@ -212,200 +315,791 @@ func (db *DB) FindAllIdsForTags(tblName string, searchTags []string) ([]string,
 		}
 	}
 
-	return ids, nil
+	return db.liveIds(tblName, ids), nil
 
 }
 
 // Create creates a new record for the specified table.
 // It takes a table name, and a struct representing the record data.
-// It returns the id of the newly created record and any error encountered.
-func createWithId(db *DB, tblName string, fileId string, rec interface{}) (string, error) {
-	marshalledRec, err := json.Marshal(rec)
-
+// It returns the id of the newly created record and any error encountered,
+// including ErrExists if the table's IdGenerator hands out an id already in
+// use.
+func (db *DB) Create(tblName string, rec interface{}) (string, error) {
+	fileId, _, err := db.save(tblName, "", rec, putInsert)
 	if err != nil {
 		return "", err
 	}
 
-	filename := db.filePath(tblName, fileId)
+	return fileId, nil
+}
 
-	err = ioutil.WriteFile(filename, marshalledRec, 0600)
+// CreateWithId creates a new record with a supplied id for the specified
+// table, overwriting any existing record with that id.
+// It takes a table name, the record id and a struct representing the record
+// data. It returns the id of the record and any error encountered.
+func (db *DB) CreateWithId(tblName string, fileId string, rec interface{}) (string, error) {
+	_, _, err := db.save(tblName, fileId, rec, putAny)
 	if err != nil {
 		return "", err
 	}
 
-	err = db.initTblIndexes(tblName)
-	if err != nil {
-		return fileId, err
-	}
-
 	return fileId, nil
 }
 
-func (db *DB) Create(tblName string, rec interface{}) (string, error) {
-	db.rwLocks[tblName].Lock()
-	defer db.rwLocks[tblName].Unlock()
+// Insert creates a new record with a supplied id for the specified table.
+// It takes a table name, the record id and a struct representing the record
+// data. It returns ErrExists if a record with that id already exists, or any
+// other error encountered.
+func (db *DB) Insert(tblName string, fileId string, rec interface{}) error {
+	_, _, err := db.save(tblName, fileId, rec, putInsert)
 
-	fileId, err := db.nextAvailableFileId(tblName)
-	if err != nil {
-		return "", err
-	}
-	return createWithId(db, tblName, fileId, rec)
+	return err
 }
 
-func (db *DB) CreateWithId(tblName string, fileId string, rec interface{}) (string, error) {
-	db.rwLocks[tblName].Lock()
-	defer db.rwLocks[tblName].Unlock()
-	return createWithId(db, tblName, fileId, rec)
+// Replace overwrites an existing record for the specified table.
+// It takes a table name, the record id and a struct representing the record
+// data. It returns ErrNotFound if there is no record with that id, or any other
+// error encountered.
+func (db *DB) Replace(tblName string, fileId string, rec interface{}) error {
+	_, _, err := db.save(tblName, fileId, rec, putReplace)
+
+	return err
+}
+
+// Upsert creates or overwrites a record with a supplied id for the specified
+// table. It takes a table name, the record id and a struct representing the
+// record data. It returns true if the record was inserted, false if an existing
+// record was updated, and any error encountered.
+func (db *DB) Upsert(tblName string, fileId string, rec interface{}) (bool, error) {
+	_, inserted, err := db.save(tblName, fileId, rec, putAny)
+
+	return inserted, err
 }
 
 // Update updates a record for the specified table.
 // It takes a table name, a struct representing the record data, and the record
 // id of the record to be changed.  It returns any error encountered.
 func (db *DB) Update(tblName string, rec interface{}, fileId string) error {
-	db.rwLocks[tblName].Lock()
-	defer db.rwLocks[tblName].Unlock()
+	_, _, err := db.save(tblName, fileId, rec, putAny)
+
+	return err
+}
+
+// Delete deletes a record for the specified table.
+// It takes a table name and the record id of the record to be deleted..
+// Records in other tables that reference it are deleted or updated as their
+// References say, all under the same locks. It returns ErrReferenced if a
+// Restrict reference still points at the record, or any error encountered.
+func (db *DB) Delete(tblName string, fileId string) error {
+	return db.delete(tblName, fileId, nil)
+}
+
+// DeleteRecord deletes a record like Delete, after loading it into a Record
+// struct as Find does, so that the struct's BeforeDelete and AfterDelete hooks
+// run. It takes a table name, a pointer to a Record struct, and the record id
+// of the record to be deleted. It returns any error encountered.
+func (db *DB) DeleteRecord(tblName string, rec Record, fileId string) error {
+	return db.delete(tblName, fileId, rec)
+}
+
+// Close closes an ivy database.
+func (db *DB) Close() {
+	if db.stopReaper != nil {
+		close(db.stopReaper)
+		<-db.reaperDone
+		db.stopReaper = nil
+	}
+
+	for _, rwLock := range db.rwLocks {
+		rwLock.Lock()
+		rwLock.Unlock()
+	}
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
 
-	// Is fileid valid?
-	_, err := strconv.Atoi(fileId)
+// openDB opens a database for OpenDBWithOptions. Without buildIndexes the
+// configured tables are left unindexed and no reaper is started, which only
+// suits a database opened for checking.
+func openDB(dbPath string, fieldsToIndex map[string][]string, tblOptions map[string]*TableOptions, buildIndexes bool) (*DB, error) {
+	db := new(DB)
+
+	db.path = dbPath
+	db.fieldsToIndex = fieldsToIndex
+	db.tblOptions = tblOptions
+
+	err := db.performChecks()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	marshalledRec, err := json.Marshal(rec)
+	db.rwLocks = make(map[string]*sync.RWMutex)
+
+	db.tagIndexes = make(map[string]map[string][]string) // I don't actually care about this
+	db.fldIndexes = make(map[string]map[string]map[string][]string)
+	db.fldValues = make(map[string]map[string]map[string]string)
+	db.fuzzyIndexes = make(map[string]map[string]*bkTree)
+	db.vecIndexes = make(map[string]map[string]*vectorIndex)
+	db.geoIndexes = make(map[string]map[string]*geoIndex)
+	db.refIndexes = make(map[string]map[string]map[string][]string)
+	db.expiries = make(map[string]map[string]time.Time)
+	db.segments = make(map[string]*segmentStore)
+
+	files, _ := ioutil.ReadDir(db.path)
 
+	for _, file := range files {
+		if file.IsDir() {
+			if file.Name() != "." && file.Name() != ".." {
+				db.rwLocks[file.Name()] = new(sync.RWMutex)
+			}
+		}
+	}
+
+	err = db.openSegments()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	filename := db.filePath(tblName, fileId)
+	if !buildIndexes {
+		db.unindexed = make(map[string]bool)
+		for _, tblName := range db.configuredTbls() {
+			db.unindexed[tblName] = true
+		}
+		return db, nil
+	}
 
-	err = ioutil.WriteFile(filename, marshalledRec, 0600)
+	for _, tblName := range db.configuredTbls() {
+		err := db.initTblIndexes(tblName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db.startReaper()
+
+	return db, nil
+}
+
+// fileIdsInDataDir returns the ids of all records in a table.
+func (db *DB) fileIdsInDataDir(tblName string) []string {
+	return db.store(tblName).ids()
+}
+
+// fileIdsInDir returns the ids of all files in a directory with an extension.
+func fileIdsInDir(dir string, ext string) []string {
+	var ids []string
+
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		if !file.IsDir() {
+			if path.Ext(file.Name()) == ext {
+				ids = append(ids, file.Name()[:len(file.Name())-len(ext)])
+			}
+		}
+	}
+
+	return ids
+}
+
+// filePath returns a file name for a table name and a file id.
+func (db *DB) filePath(tblName string, fileId string) string {
+	return fmt.Sprintf("%v/%v%v", db.tblPath(tblName), fileId, db.codec(tblName).Ext())
+}
+
+// loadRec reads a record file into the supplied interface.
+func (db *DB) loadRec(tblName string, rec interface{}, fileId string) error {
+	data, err := db.readRecData(tblName, fileId)
 	if err != nil {
 		return err
 	}
 
-	err = db.initTblIndexes(tblName)
+	err = json.Unmarshal(data, rec)
+
+	return err
+}
+
+// readRecData reads a record with readSealedRec and opens its encrypted
+// fields. It returns the record as JSON and any error encountered.
+func (db *DB) readRecData(tblName string, fileId string) ([]byte, error) {
+	data, err := db.readSealedRec(tblName, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.openFields(tblName, data)
+}
+
+// readSealedRec reads a record file, unseals it and decodes it with the
+// table's codec, leaving its encrypted fields encrypted. It returns the record
+// as JSON and any error encountered, which wraps ErrCorrupt if the file fails
+// its checksum or does not decode to a JSON object.
+func (db *DB) readSealedRec(tblName string, fileId string) ([]byte, error) {
+	stored, err := db.store(tblName).read(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := db.unseal(tblName, stored)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s/%s: %v", ErrCorrupt, tblName, fileId, err)
+	}
+
+	data, err := db.codec(tblName).Decode(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s/%s: %v", ErrCorrupt, tblName, fileId, err)
+	}
+
+	if !json.Valid(data) || firstByte(data) != '{' {
+		return nil, fmt.Errorf("%w: %s/%s: not a JSON object", ErrCorrupt, tblName, fileId)
+	}
+
+	return data, nil
+}
+
+// seal turns an encoded record into the bytes stored on disk, compressing,
+// encrypting and checksumming it as the table's settings call for.
+func (db *DB) seal(tblName string, encoded []byte) ([]byte, error) {
+	compressed, err := db.compress(tblName, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := db.encrypt(tblName, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.checksum(tblName, encrypted), nil
+}
+
+// unseal is the inverse of seal.
+func (db *DB) unseal(tblName string, stored []byte) ([]byte, error) {
+	encrypted, err := verifyChecksum(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed, err := db.decrypt(tblName, encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	return decompress(compressed)
+}
+
+// save takes the table's write lock and puts a record, allocating a new id
+// first if fileId is empty. Once the lock is released it runs the table's
+// after-create or after-update hooks. It returns the record id, whether the
+// record was newly inserted and any error encountered.
+func (db *DB) save(tblName string, fileId string, rec interface{}, mode int) (string, bool, error) {
+	var inserted bool
+	var err error
+
+	unlock := db.writeLocks(tblName)
+
+	if fileId == "" {
+		fileId, err = db.nextId(tblName)
+	}
+	if err == nil {
+		inserted, err = db.put(tblName, fileId, rec, mode)
+	}
+
+	unlock()
+
+	if err != nil {
+		return "", false, err
+	}
+
+	db.afterWrite(tblName, fileId, rec, inserted)
+
+	return fileId, inserted, nil
+}
+
+// put writes a record and updates the table's indexes for it. The mode decides
+// whether the record may, must or must not already exist; an expired record
+// that has not been reaped yet counts as missing. It returns whether the record
+// was newly inserted and any error encountered. The caller must hold the
+// table's write lock.
+func (db *DB) put(tblName string, fileId string, rec interface{}, mode int) (bool, error) {
+	if !validFileId(fileId) {
+		return false, ErrInvalidId
+	}
+
+	onDisk := db.recExists(tblName, fileId)
+	exists := onDisk && !db.isExpired(tblName, fileId)
+
+	if exists && mode == putInsert {
+		return false, ErrExists
+	}
+	if !exists && mode == putReplace {
+		return false, ErrNotFound
+	}
+
+	// The old record is needed to take it out of the indexes. If it cannot be
+	// read, the indexes are rebuilt instead.
+	var oldRec, replaced map[string]interface{}
+	var oldErr error
+	if onDisk {
+		oldRec, oldErr = db.loadRecMap(tblName, fileId)
+	}
+	if exists {
+		replaced = oldRec
+	}
+
+	err := db.beforeWrite(tblName, fileId, rec, !exists)
+	if err != nil {
+		return false, err
+	}
+
+	newRec, err := db.writeRec(tblName, fileId, rec, replaced)
+	if err != nil {
+		return false, err
+	}
+
+	if oldErr != nil {
+		err = db.initTblIndexes(tblName)
+	} else {
+		err = db.updateRecIndexes(tblName, fileId, oldRec, newRec)
+	}
+	if err != nil {
+		return !exists, err
+	}
+
+	return !exists, nil
+}
+
+// mutate takes the table's write lock and applies a change to a single record
+// with mutateRec. Once the lock is released it runs the table's after-update
+// hooks. It returns any error encountered.
+func (db *DB) mutate(tblName string, fileId string, change func(rec map[string]interface{}) error) error {
+	unlock := db.writeLocks(tblName)
+	rec, err := db.mutateRec(tblName, fileId, change)
+	unlock()
+
 	if err != nil {
 		return err
 	}
 
+	if rec != nil {
+		db.afterWrite(tblName, fileId, rec, false)
+	}
+
 	return nil
 }
 
-// Delete deletes a record for the specified table.
-// It takes a table name and the record id of the record to be deleted..
-// It returns any error encountered.
-func (db *DB) Delete(tblName string, fileId string) error {
-	_, err := strconv.Atoi(fileId)
+// mutateRec applies a change to a single record in place and updates the
+// table's indexes for only the fields that changed. It takes a table name, the
+// record id and a function that edits the decoded record. If the function
+// returns an error nothing is written; errUnchanged is not reported as one.
+// It returns the changed record, or nil if nothing changed, and ErrNotFound if
+// there is no live record with that id, or any other error encountered. The
+// caller must hold the table's write lock.
+func (db *DB) mutateRec(tblName string, fileId string, change func(rec map[string]interface{}) error) (map[string]interface{}, error) {
+	if !validFileId(fileId) {
+		return nil, ErrInvalidId
+	}
+
+	var oldRec, newRec map[string]interface{}
+
+	if db.isExpired(tblName, fileId) {
+		return nil, ErrNotFound
+	}
+
+	data, err := db.readRecData(tblName, fileId)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	filename := db.filePath(tblName, fileId)
+	// Work on a copy, so the old values are still around for the indexes.
+	err = json.Unmarshal(data, &oldRec)
+	if err == nil {
+		err = json.Unmarshal(data, &newRec)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	db.rwLocks[tblName].Lock()
-	defer db.rwLocks[tblName].Unlock()
+	err = change(newRec)
+	if err == errUnchanged {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.beforeWrite(tblName, fileId, newRec, false)
+	if err != nil {
+		return nil, err
+	}
+
+	written, err := db.writeRec(tblName, fileId, newRec, oldRec)
+	if err != nil {
+		return nil, err
+	}
+
+	return written, db.updateRecIndexes(tblName, fileId, oldRec, written)
+}
 
-	err = os.Remove(filename)
+// delete takes the locks a delete needs and carries it out, loading the
+// record into rec first if it is not nil. Once the locks are released it runs
+// the after-update and after-delete hooks. It returns any error encountered.
+func (db *DB) delete(tblName string, fileId string, rec Record) error {
+	if !validFileId(fileId) {
+		return ErrInvalidId
+	}
+
+	unlock := db.deleteLocks(tblName)
+
+	plan, err := db.planDelete(tblName, fileId)
+	if err == nil && rec != nil {
+		if db.isExpired(tblName, fileId) {
+			err = db.notFoundErr(tblName, fileId)
+		} else {
+			err = db.loadRec(tblName, rec, fileId)
+		}
+		if err == nil {
+			rec.AfterFind(db, fileId)
+			plan.rec = rec
+		}
+	}
 	if err != nil {
+		unlock()
 		return err
 	}
 
-	err = db.initTblIndexes(tblName)
+	updated, err := db.applyDelete(plan)
+	unlock()
+
 	if err != nil {
 		return err
 	}
 
+	for key, written := range updated {
+		db.afterWrite(key.tblName, key.fileId, written, false)
+	}
+	for i, key := range plan.order {
+		var doomed interface{}
+		if i == 0 {
+			doomed = plan.rec
+		}
+
+		db.afterDelete(key.tblName, key.fileId, doomed)
+	}
+
 	return nil
 }
 
-// Close closes an ivy database.
-func (db *DB) Close() {
-	for _, rwLock := range db.rwLocks {
-		rwLock.Lock()
-		rwLock.Unlock()
+// removeRec removes a record file, or moves it to the trash for soft-delete
+// tables. Like writeRaw, it saves the deletion to the history first. The
+// caller must hold the table's write lock and update its indexes.
+func (db *DB) removeRec(tblName string, fileId string) error {
+	if db.options(tblName).History {
+		err := db.saveRevision(tblName, fileId, nil)
+		if err != nil {
+			return err
+		}
 	}
+
+	if db.options(tblName).SoftDelete {
+		return db.trashRec(tblName, fileId)
+	}
+	return db.store(tblName).remove(fileId)
 }
 
-//*****************************************************************************
-// Private DB Methods
-//*****************************************************************************
+// updateRecIndexes updates a table's indexes after a single record changed
+// from oldRec to newRec, leaving the indexes of unchanged fields untouched.
+// oldRec is nil for a new record.
+func (db *DB) updateRecIndexes(tblName string, fileId string, oldRec map[string]interface{}, newRec map[string]interface{}) error {
+	changed := func(fldName string) bool {
+		return !reflect.DeepEqual(oldRec[fldName], newRec[fldName])
+	}
 
-// fileIdsInDataDir returns all file ids in a directory.
-func (db *DB) fileIdsInDataDir(tblName string) []string {
-	var ids []string
+	for _, fldName := range db.fieldsToIndex[tblName] {
+		if !changed(fldName) {
+			continue
+		}
 
-	files, _ := ioutil.ReadDir(db.tblPath(tblName))
-	for _, file := range files {
-		if !file.IsDir() {
-			if path.Ext(file.Name()) == ".json" {
-				ids = append(ids, file.Name()[:len(file.Name())-5])
+		/* I don't actually care about this */
+		if fldName == "tags" {
+			for _, tag := range stringsOf(oldRec["tags"]) {
+				db.tagIndexes[tblName][tag] = removeString(db.tagIndexes[tblName][tag], fileId)
+				if len(db.tagIndexes[tblName][tag]) == 0 {
+					delete(db.tagIndexes[tblName], tag)
+				}
+			}
+			for _, tag := range stringsOf(newRec["tags"]) {
+				if !stringInSlice(fileId, db.tagIndexes[tblName][tag]) {
+					db.tagIndexes[tblName][tag] = append(db.tagIndexes[tblName][tag], fileId)
+				}
+			}
+			continue
+		}
+
+		index, ok := db.fldIndexes[tblName][fldName]
+		if !ok {
+			continue
+		}
+
+		var droppedKey, addedKey bool
+
+		if oldValue, ok := oldRec[fldName].(string); ok {
+			oldValue = db.indexKey(tblName, fldName, oldValue)
+			index[oldValue] = removeString(index[oldValue], fileId)
+			if len(index[oldValue]) == 0 {
+				delete(index, oldValue)
+				droppedKey = true
+			}
+		}
+		if newValue, ok := newRec[fldName].(string); ok {
+			key := db.indexKey(tblName, fldName, newValue)
+			if _, ok := index[key]; !ok {
+				addedKey = true
+			}
+			if !stringInSlice(fileId, index[key]) {
+				index[key] = append(index[key], fileId)
+			}
+			if values, ok := db.fldValues[tblName][fldName]; ok {
+				values[fileId] = newValue
+			}
+		} else {
+			delete(db.fldValues[tblName][fldName], fileId)
+		}
+
+		if db.encryptedField(tblName, fldName) {
+			continue
+		}
+
+		// A bk-tree cannot drop a value, so rebuild the one for just this field
+		// when a value left the index.
+		if droppedKey {
+			tree := new(bkTree)
+			for fldValue := range index {
+				tree.add(fldValue)
 			}
+			db.fuzzyIndexes[tblName][fldName] = tree
+		} else if addedKey {
+			db.fuzzyIndexes[tblName][fldName].add(db.indexKey(tblName, fldName, newRec[fldName].(string)))
 		}
 	}
 
-	return ids
+	for _, spec := range db.options(tblName).VectorIndexes {
+		if changed(spec.Field) {
+			vec, ok := toVector(newRec[spec.Field])
+			db.vecIndexes[tblName][spec.Field].update(fileId, vec, ok)
+		}
+	}
+
+	for _, spec := range db.options(tblName).GeoIndexes {
+		if changed(spec.PointField) || changed(spec.LatField) || changed(spec.LonField) {
+			lat, lon, ok := geoPointOf(spec, newRec)
+			db.geoIndexes[tblName][geoIndexName(spec)].update(fileId, lat, lon, ok)
+		}
+	}
+
+	for _, ref := range db.options(tblName).References {
+		if !changed(ref.Field) {
+			continue
+		}
+
+		index := db.refIndexes[tblName][ref.Field]
+		for _, refId := range refIds(oldRec[ref.Field]) {
+			index[refId] = removeString(index[refId], fileId)
+			if len(index[refId]) == 0 {
+				delete(index, refId)
+			}
+		}
+		for _, refId := range refIds(newRec[ref.Field]) {
+			if !stringInSlice(fileId, index[refId]) {
+				index[refId] = append(index[refId], fileId)
+			}
+		}
+	}
+
+	return nil
 }
 
-// filePath returns a file name for a table name and a file id.
-func (db *DB) filePath(tblName string, fileId string) string {
-	return fmt.Sprintf("%v/%v.json", db.tblPath(tblName), fileId)
+// recExists answers whether a record exists.
+func (db *DB) recExists(tblName string, fileId string) bool {
+	return db.store(tblName).exists(fileId)
 }
 
-// loadRec reads a json file into the supplied interface.
-func (db *DB) loadRec(tblName string, rec interface{}, fileId string) error {
-	filename := db.filePath(tblName, fileId)
+// writeRec marshals a record, sets the fields Ivy maintains, validates it
+// against the table's schema and writes it to its file, saving a revision for
+// tables that keep history.
+// oldRec is the record it replaces, or nil for a new record. It returns the
+// record as written, decoded into a map, and any error encountered.
+func (db *DB) writeRec(tblName string, fileId string, rec interface{}, oldRec map[string]interface{}) (map[string]interface{}, error) {
+	var written map[string]interface{}
+
+	marshalledRec, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
 
-	data, err := ioutil.ReadFile(filename)
+	err = json.Unmarshal(marshalledRec, &written)
+	if err != nil {
+		return nil, err
+	}
+
+	stamped := db.options(tblName).Timestamps || db.expiring(tblName)
+	if stamped {
+		db.stampRec(tblName, fileId, written, oldRec)
+	}
+
+	err = db.validateRec(tblName, written)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(db.options(tblName).References) > 0 {
+		err = db.checkRefs(tblName, written)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if stamped {
+		marshalledRec, err = json.Marshal(written)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = db.writeRaw(tblName, fileId, marshalledRec)
+	if err != nil {
+		return nil, err
+	}
+
+	if db.expiring(tblName) {
+		db.trackExpiry(tblName, fileId, written)
+	}
+
+	return written, nil
+}
+
+// writeRaw encrypts the encrypted fields of an already marshalled record,
+// encodes it with the table's codec, seals it and writes it to the table's
+// store. Tables that keep history save the revision first, so that a failure
+// to save it leaves the record, and so the indexes, as they were.
+func (db *DB) writeRaw(tblName string, fileId string, marshalledRec []byte) error {
+	// Without field keys the encrypted fields were read as null, and writing
+	// them back would lose them.
+	if fe := db.options(tblName).FieldEncryption; fe != nil && fe.Keys == nil {
+		return fmt.Errorf("%w: table %s has no field key provider", ErrKeyNotFound, tblName)
+	}
+
+	sealedRec, err := db.sealFields(tblName, marshalledRec)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(data, rec)
+	encoded, err := db.codec(tblName).Encode(sealedRec)
+	if err != nil {
+		return err
+	}
 
-	return err
+	stored, err := db.seal(tblName, encoded)
+	if err != nil {
+		return err
+	}
+
+	if db.options(tblName).History {
+		err = db.saveRevision(tblName, fileId, sealedRec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.store(tblName).write(fileId, stored)
 }
 
-// initNonTagsIndexes initializes all non-tag indexes for a table.
-func (db *DB) initNonTagsIndexes(tblName string) error {
+// stampRec sets the fields Ivy maintains in a decoded record: updated_at to
+// the current time and created_at to the time the record was first written for
+// tables with timestamps, and expires_at for tables that track expiry. oldRec
+// is the record it replaces, or nil for a new record.
+func (db *DB) stampRec(tblName string, fileId string, rec map[string]interface{}, oldRec map[string]interface{}) {
+	if db.options(tblName).Timestamps {
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+
+		rec[CreatedAtField] = now
+		if createdAt, ok := oldRec[CreatedAtField]; ok {
+			rec[CreatedAtField] = createdAt
+		}
+		rec[UpdatedAtField] = now
+	}
+
+	if db.expiring(tblName) {
+		db.stampExpiry(tblName, rec, oldRec)
+	}
+}
+
+// loadRecMap reads a json file into a generic map.
+func (db *DB) loadRecMap(tblName string, fileId string) (map[string]interface{}, error) {
 	var rec map[string]interface{}
 
+	err := db.loadRec(tblName, &rec, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// initNonTagsIndexes initializes all non-tag indexes for a table.
+func (db *DB) initNonTagsIndexes(tblName string) error {
 	// Delete all the indexes for this table.
 	for k := range db.fldIndexes[tblName] {
 		delete(db.fldIndexes[tblName], k)
 	}
 
 	db.fldIndexes[tblName] = make(map[string]map[string][]string)
+	db.fldValues[tblName] = make(map[string]map[string]string)
 
 	// Reinit all the indexes for this table.
 	for _, fldName := range db.fieldsToIndex[tblName] {
-		if fldName != "tags" {
+		if db.indexedField(tblName, fldName) {
 			db.fldIndexes[tblName][fldName] = make(map[string][]string)
 		}
+		if fldName != "tags" && !db.encryptedField(tblName, fldName) {
+			db.fldValues[tblName][fldName] = make(map[string]string)
+		}
 	}
 
 	// For every file in the data dir...
 	for _, fileId := range db.fileIdsInDataDir(tblName) {
-		filename := db.filePath(tblName, fileId)
-
-		data, err := ioutil.ReadFile(filename)
-		if err != nil {
-			return err
-		}
-
-		err = json.Unmarshal(data, &rec)
+		rec, err := db.loadRecMap(tblName, fileId)
 		if err != nil {
 			return err
 		}
 
 		for _, fldName := range db.fieldsToIndex[tblName] {
-			// Skip tags because we index them separately
-			if fldName == "tags" {
+			// Skip tags because we index them separately, and encrypted fields
+			// without a blind index.
+			if !db.indexedField(tblName, fldName) {
+				continue
+			}
+
+			// Convert back into a string, skipping values that are missing or are
+			// not strings.
+			fldValue, ok := rec[fldName].(string)
+			if !ok {
 				continue
 			}
 
-			// Convert back into a string.
-			fldValue := rec[fldName].(string)
+			// Keep the value by record id too, for projections.
+			if values, ok := db.fldValues[tblName][fldName]; ok {
+				values[fileId] = fldValue
+			}
+
+			fldValue = db.indexKey(tblName, fldName, fldValue)
 
 			// If the field value already exists as a key in the index...
 			if fileIds, ok := db.fldIndexes[tblName][fldName][fldValue]; ok {
@@ -422,13 +1116,14 @@ func (db *DB) initNonTagsIndexes(tblName string) error {
 		}
 	}
 
+	db.initFuzzyIndexes(tblName)
+
 	return nil
 }
 
 /* I don't actually care about this */
 // initTagsIndex initializes all tag indexes for a database.
 func (db *DB) initTagsIndex(tblName string) error {
-	var rec map[string]interface{}
 	tagIndex := make(map[string][]string)
 
 	// Delete all the entries in the index.
@@ -438,25 +1133,13 @@ func (db *DB) initTagsIndex(tblName string) error {
 
 	// For every file in the data dir...
 	for _, fileId := range db.fileIdsInDataDir(tblName) {
-		filename := db.filePath(tblName, fileId)
-
-		data, err := ioutil.ReadFile(filename)
-		if err != nil {
-			return err
-		}
-
-		err = json.Unmarshal(data, &rec)
+		rec, err := db.loadRecMap(tblName, fileId)
 		if err != nil {
 			return err
 		}
 
-		// Convert back into a slice.
-		tags := rec["tags"].([]interface{})
-
-		// For every tag in the answer...
-		for _, t := range tags {
-			// Convert tag back into a string
-			tag := t.(string)
+		// For every string tag in the answer...
+		for _, tag := range stringsOf(rec["tags"]) {
 
 			// If the tag already exists as a key in the index...
 			if fileIds, ok := tagIndex[tag]; ok {
@@ -479,6 +1162,13 @@ func (db *DB) initTagsIndex(tblName string) error {
 
 // initTblIndexes initializes all indexes for a table.
 func (db *DB) initTblIndexes(tblName string) error {
+	if db.options(tblName).QuarantineCorrupt {
+		err := db.quarantineCorrupt(tblName)
+		if err != nil {
+			return err
+		}
+	}
+
 	if fldNames, ok := db.fieldsToIndex[tblName]; ok {
 		err := db.initNonTagsIndexes(tblName)
 		if err != nil {
@@ -487,25 +1177,77 @@ func (db *DB) initTblIndexes(tblName string) error {
 
 		/* I don't actually care about this */
 		if stringInSlice("tags", fldNames) {
-			db.initTagsIndex(tblName)
+			err = db.initTagsIndex(tblName)
 			if err != nil {
 				return err
 			}
 		}
 	}
+
+	if len(db.options(tblName).VectorIndexes) > 0 {
+		err := db.initVectorIndexes(tblName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(db.options(tblName).GeoIndexes) > 0 {
+		err := db.initGeoIndexes(tblName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if db.expiring(tblName) {
+		err := db.initExpiryIndex(tblName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(db.options(tblName).References) > 0 {
+		err := db.initRefIndexes(tblName)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// nextId returns a new record id for a table, from the table's IdGenerator if
+// it has one.
+func (db *DB) nextId(tblName string) (string, error) {
+	if gen := db.options(tblName).IdGenerator; gen != nil {
+		return db.generateId(tblName, gen)
+	}
+	return db.nextAvailableFileId(tblName)
+}
+
+// generateId returns a new record id from an IdGenerator. A sequence is
+// seeded from the table's record store, so that it sees the records of tables
+// using segment storage too.
+func (db *DB) generateId(tblName string, gen IdGenerator) (string, error) {
+	if seq, ok := gen.(*sequenceGenerator); ok {
+		return seq.next(db.tblPath(tblName), db.store(tblName).ids)
+	}
+	return gen.NextId(db.tblPath(tblName))
+}
+
 // nextAvailableFileId returns the next ascending available file id in a
-// directory.
+// directory. Non-numeric ids, such as those given to CreateWithId, are
+// ignored. Soft deleted records keep their ids, so that a new record never
+// takes the id of one that may still be restored.
 func (db *DB) nextAvailableFileId(tblName string) (string, error) {
 	var fileIds []int
 	var nextFileId string
 
-	for _, f := range db.fileIdsInDataDir(tblName) {
+	trashed := fileIdsInDir(db.trashPath(tblName), db.codec(tblName).Ext())
+
+	for _, f := range append(db.fileIdsInDataDir(tblName), trashed...) {
 		fileId, err := strconv.Atoi(f)
 		if err != nil {
-			return "", err
+			continue
 		}
 
 		fileIds = append(fileIds, fileId)
@@ -528,15 +1270,100 @@ func (db *DB) performChecks() error {
 	if _, err := os.Stat(db.path); os.IsNotExist(err) {
 		return err
 	}
-	for tbl := range db.fieldsToIndex {
+	for _, tbl := range db.configuredTbls() {
 		if _, err := os.Stat(db.tblPath(tbl)); os.IsNotExist(err) {
 			return err
 		}
+
+		if schema := db.options(tbl).Schema; schema != nil {
+			err := schema.compile()
+			if err != nil {
+				return err
+			}
+		}
+
+		if db.options(tbl).ReapInterval < 0 {
+			return fmt.Errorf("ivy: bad reap interval for table %s", tbl)
+		}
+
+		if s := db.options(tbl).Segments; s != nil && s.MaxSegmentSize < 0 {
+			return fmt.Errorf("ivy: bad segment settings for table %s", tbl)
+		}
+
+		if c := db.options(tbl).Compression; c != nil {
+			if c.Algorithm < Gzip || c.Algorithm > Flate || c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+				return fmt.Errorf("ivy: bad compression settings for table %s", tbl)
+			}
+		}
+
+		if keys := db.options(tbl).Encryption; keys != nil {
+			_, key, err := keys.CurrentKey()
+			if err == nil {
+				_, err = newGCM(key)
+			}
+			if err != nil {
+				return fmt.Errorf("ivy: bad encryption key for table %s: %v", tbl, err)
+			}
+		}
+
+		if fe := db.options(tbl).FieldEncryption; fe != nil {
+			for _, fldName := range fe.Fields {
+				if fldName == "" || fldName == "tags" {
+					return fmt.Errorf("ivy: bad encrypted field %q in table %s", fldName, tbl)
+				}
+			}
+			if fe.Keys != nil {
+				_, key, err := fe.Keys.CurrentKey()
+				if err == nil {
+					_, err = newGCM(key)
+				}
+				if err != nil {
+					return fmt.Errorf("ivy: bad field encryption key for table %s: %v", tbl, err)
+				}
+			}
+		}
+
+		for _, ref := range db.options(tbl).References {
+			if ref.Field == "" || ref.OnDelete < Restrict || ref.OnDelete > SetNull {
+				return fmt.Errorf("ivy: bad reference from table %s field %q", tbl, ref.Field)
+			}
+			if _, err := os.Stat(db.tblPath(ref.Table)); ref.Table == "" || os.IsNotExist(err) {
+				return fmt.Errorf("ivy: table %s field %s references missing table %q", tbl, ref.Field, ref.Table)
+			}
+		}
 	}
 
 	return nil
 }
 
+// configuredTbls returns the names of all tables that have indexes or options
+// configured, in sorted order.
+func (db *DB) configuredTbls() []string {
+	var tblNames []string
+
+	for tblName := range db.fieldsToIndex {
+		tblNames = append(tblNames, tblName)
+	}
+	for tblName := range db.tblOptions {
+		if _, ok := db.fieldsToIndex[tblName]; !ok {
+			tblNames = append(tblNames, tblName)
+		}
+	}
+
+	sort.Strings(tblNames)
+
+	return tblNames
+}
+
+// options returns the options for a table, or empty options if none were
+// supplied.
+func (db *DB) options(tblName string) *TableOptions {
+	if opts, ok := db.tblOptions[tblName]; ok && opts != nil {
+		return opts
+	}
+	return &TableOptions{}
+}
+
 // tblPath returns the file path for a table directory.
 func (db *DB) tblPath(tblName string) string {
 	return path.Join(db.path, tblName)
@@ -546,6 +1373,37 @@ func (db *DB) tblPath(tblName string) string {
 // Helper Functions
 //=============================================================================
 
+// validFileId answers whether a record id can safely be used as a file name.
+func validFileId(fileId string) bool {
+	return fileId != "" && !strings.HasPrefix(fileId, ".") && !strings.ContainsAny(fileId, "/\\")
+}
+
+// removeString returns a copy of a slice without any occurrence of a string.
+func removeString(list []string, s string) []string {
+	var kept []string
+	for _, x := range list {
+		if x != s {
+			kept = append(kept, x)
+		}
+	}
+	return kept
+}
+
+// stringsOf converts a decoded JSON array back into a slice of its string
+// elements.
+func stringsOf(v interface{}) []string {
+	var list []string
+
+	arr, _ := v.([]interface{})
+	for _, x := range arr {
+		if s, ok := x.(string); ok {
+			list = append(list, s)
+		}
+	}
+
+	return list
+}
+
 // stringInSlice answers whether a string exists in a slice.
 func stringInSlice(s string, list []string) bool {
 	for _, x := range list {
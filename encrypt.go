@@ -0,0 +1,266 @@
+package ivy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Type KeyProvider supplies the AES keys of a table with TableOptions.Encryption
+// set. Keys are 16, 24 or 32 bytes long, selecting AES-128, AES-192 or
+// AES-256, and are numbered by version. Records are encrypted with the current
+// key and remember the version they were encrypted with, so they stay readable
+// after the current key changes for as long as the provider still returns the
+// old key. RotateKeys re-encrypts old records with the current key.
+type KeyProvider interface {
+	// CurrentKey returns the version and bytes of the key to encrypt with.
+	CurrentKey() (uint32, []byte, error)
+
+	// Key returns the bytes of the key with a version, or ErrKeyNotFound.
+	Key(version uint32) ([]byte, error)
+}
+
+// ErrKeyNotFound is returned when a record was encrypted with a key that the
+// table's KeyProvider does not have, or the table has no KeyProvider.
+var ErrKeyNotFound = errors.New("ivy: encryption key not found")
+
+// storedFile names a record or revision in a store, for RotateKeys.
+type storedFile struct {
+	st     recStore
+	fileId string
+}
+
+// encryptMagic starts every encrypted file, followed by the key version as a
+// big endian uint32, the GCM nonce and the sealed data.
+var encryptMagic = []byte("\x00IVE")
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// RotateKeys re-encrypts the records of a table, including soft deleted
+// records and history, that are not encrypted with the table's current key.
+// Records that are not encrypted at all are encrypted, so RotateKeys also
+// encrypts an existing table in place. The table's write lock is only held
+// while each file is rewritten, so RotateKeys can run in its own goroutine
+// while the database is in use. It takes a table name. It returns the number
+// of files rewritten and any error encountered.
+func (db *DB) RotateKeys(tblName string) (int, error) {
+	var files []storedFile
+
+	rotated := 0
+
+	keys := db.options(tblName).Encryption
+	if keys == nil {
+		return 0, fmt.Errorf("%w: table %s is not encrypted", ErrKeyNotFound, tblName)
+	}
+
+	current, _, err := keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	db.rwLocks[tblName].RLock()
+	for _, st := range []recStore{db.store(tblName), db.trashStore(tblName)} {
+		for _, fileId := range st.ids() {
+			files = append(files, storedFile{st, fileId})
+		}
+	}
+	historyDirs, _ := ioutil.ReadDir(path.Join(db.tblPath(tblName), historyDir))
+	for _, dir := range historyDirs {
+		revs, _ := db.revisions(tblName, dir.Name())
+		for _, r := range revs {
+			files = append(files, storedFile{fileStore{dir: db.historyPath(tblName, dir.Name())}, revisionFileName(r)})
+		}
+	}
+	db.rwLocks[tblName].RUnlock()
+
+	for _, file := range files {
+		done, err := db.rotateFile(tblName, file, current)
+		if err != nil {
+			return rotated, err
+		}
+		if done {
+			rotated++
+		}
+	}
+
+	return rotated, nil
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// rotateFile re-encrypts a single record or revision with the current key,
+// under the table's write lock. It returns whether it was rewritten and any
+// error encountered. Files that have gone away since they were listed are
+// skipped.
+func (db *DB) rotateFile(tblName string, file storedFile, current uint32) (bool, error) {
+	db.rwLocks[tblName].Lock()
+	defer db.rwLocks[tblName].Unlock()
+
+	stored, err := file.st.read(file.fileId)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Deletion markers in the history are empty and stay that way.
+	if len(stored) == 0 {
+		return false, nil
+	}
+
+	encrypted, err := verifyChecksum(stored)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s: %v", ErrCorrupt, file.fileId, err)
+	}
+
+	hadChecksum := len(encrypted) < len(stored)
+
+	if version, ok := keyVersion(encrypted); ok && version == current {
+		return false, nil
+	}
+
+	plain, err := db.decrypt(tblName, encrypted)
+	if err != nil {
+		return false, err
+	}
+
+	stored, err = db.encrypt(tblName, plain)
+	if err != nil {
+		return false, err
+	}
+
+	// History revisions are not checksummed, so only files that had a
+	// checksum get a new one.
+	if hadChecksum {
+		stored = addChecksum(stored)
+	}
+
+	return true, file.st.write(file.fileId, stored)
+}
+
+// encrypt seals data with the table's current key, if the table is encrypted.
+// It returns the bytes to store and any error encountered.
+func (db *DB) encrypt(tblName string, data []byte) ([]byte, error) {
+	keys := db.options(tblName).Encryption
+	if keys == nil {
+		return data, nil
+	}
+
+	version, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptMagic)+4, len(encryptMagic)+4+gcm.NonceSize()+len(data)+gcm.Overhead())
+	copy(header, encryptMagic)
+	binary.BigEndian.PutUint32(header[len(encryptMagic):], version)
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// The header is authenticated too, so the key version cannot be altered.
+	return gcm.Seal(append(header, nonce...), nonce, data, header), nil
+}
+
+// decrypt opens data sealed by encrypt, with the key it was sealed with.
+// Data that is not encrypted is returned as it is.
+func (db *DB) decrypt(tblName string, stored []byte) ([]byte, error) {
+	version, ok := keyVersion(stored)
+	if !ok {
+		return stored, nil
+	}
+
+	keys := db.options(tblName).Encryption
+	if keys == nil {
+		return nil, fmt.Errorf("%w: table %s has no key provider", ErrKeyNotFound, tblName)
+	}
+
+	key, err := keys.Key(version)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	headerLen := len(encryptMagic) + 4
+	if len(stored) < headerLen+gcm.NonceSize() {
+		return nil, errors.New("ivy: encrypted data is truncated")
+	}
+
+	nonce := stored[headerLen : headerLen+gcm.NonceSize()]
+
+	return gcm.Open(nil, nonce, stored[headerLen+gcm.NonceSize():], stored[:headerLen])
+}
+
+//=============================================================================
+// Static Keys
+//=============================================================================
+
+// NewStaticKeyProvider returns a key provider holding a fixed set of keys,
+// keyed by version, that encrypts with the key of version current.
+func NewStaticKeyProvider(keys map[uint32][]byte, current uint32) KeyProvider {
+	return &staticKeyProvider{keys: keys, current: current}
+}
+
+type staticKeyProvider struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func (p *staticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	key, err := p.Key(p.current)
+	return p.current, key, err
+}
+
+func (p *staticKeyProvider) Key(version uint32) ([]byte, error) {
+	key, ok := p.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: version %d", ErrKeyNotFound, version)
+	}
+	return key, nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// keyVersion returns the version of the key that sealed some data, and
+// whether the data is encrypted at all.
+func keyVersion(stored []byte) (uint32, bool) {
+	if !bytes.HasPrefix(stored, encryptMagic) || len(stored) < len(encryptMagic)+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(stored[len(encryptMagic):]), true
+}
+
+// newGCM returns an AES-GCM cipher for a key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
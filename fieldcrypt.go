@@ -0,0 +1,234 @@
+package ivy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Type FieldEncryption holds the field encryption settings of a table. The
+// top-level Fields listed are stored encrypted with AES-GCM inside otherwise
+// plain records, each in an object of the form
+//
+//	{"$ivy_enc": "<base64 nonce and ciphertext>", "$ivy_key": <key version>}
+//
+// and are decrypted as records are read. A database opened without Keys reads
+// the fields as null and cannot write to the table, so processes that have no
+// business seeing the fields can still use the rest of each record.
+//
+// Plaintext values of encrypted fields never reach the field indexes. When
+// BlindIndexKey is set, an indexed encrypted field is indexed by the
+// HMAC-SHA256 of its value instead, so FindAllIdsForField and joins can still
+// find records by exact value; otherwise the field is not indexed at all.
+// Encrypted fields are left out of fuzzy indexes and covering projections.
+type FieldEncryption struct {
+	Fields        []string
+	Keys          KeyProvider
+	BlindIndexKey []byte
+}
+
+// The keys of the object an encrypted field value is stored in.
+const (
+	encFieldData = "$ivy_enc"
+	encFieldKey  = "$ivy_key"
+)
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// encryptedField answers whether a field of a table is encrypted.
+func (db *DB) encryptedField(tblName string, fldName string) bool {
+	fe := db.options(tblName).FieldEncryption
+	return fe != nil && stringInSlice(fldName, fe.Fields)
+}
+
+// indexKey returns the key a field value is indexed under: the value itself,
+// or its blind index for encrypted fields.
+func (db *DB) indexKey(tblName string, fldName string, value string) string {
+	if !db.encryptedField(tblName, fldName) {
+		return value
+	}
+
+	mac := hmac.New(sha256.New, db.options(tblName).FieldEncryption.BlindIndexKey)
+	mac.Write([]byte(fldName))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// indexedField answers whether a field of a table has a field index, which
+// encrypted fields only have if the table has a blind index key.
+func (db *DB) indexedField(tblName string, fldName string) bool {
+	if fldName == "tags" {
+		return false
+	}
+	if db.encryptedField(tblName, fldName) {
+		return len(db.options(tblName).FieldEncryption.BlindIndexKey) > 0
+	}
+	return true
+}
+
+// sealFields encrypts the encrypted fields of a marshalled record with the
+// current field key. Null values are left as they are. Every other value is
+// encrypted, even one shaped like an encrypted field object: records only get
+// here with their fields opened, so such a value came from the caller. It
+// returns the record with its fields sealed and any error encountered.
+func (db *DB) sealFields(tblName string, data []byte) ([]byte, error) {
+	fe := db.options(tblName).FieldEncryption
+	if fe == nil {
+		return data, nil
+	}
+
+	v, err := decodeJSONNumbers(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, ok := v.(map[string]interface{})
+	if !ok {
+		return data, nil
+	}
+
+	for _, fldName := range fe.Fields {
+		value, ok := rec[fldName]
+		if !ok || value == nil {
+			continue
+		}
+
+		if fe.Keys == nil {
+			return nil, fmt.Errorf("%w: table %s has no field key provider", ErrKeyNotFound, tblName)
+		}
+
+		version, key, err := fe.Keys.CurrentKey()
+		if err != nil {
+			return nil, err
+		}
+
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+
+		plain, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+
+		nonce := make([]byte, gcm.NonceSize())
+		_, err = rand.Read(nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		// The field name is authenticated, so values cannot be swapped between
+		// fields.
+		sealed := gcm.Seal(nonce, nonce, plain, []byte(fldName))
+
+		rec[fldName] = map[string]interface{}{
+			encFieldData: base64.StdEncoding.EncodeToString(sealed),
+			encFieldKey:  version,
+		}
+	}
+
+	return json.Marshal(rec)
+}
+
+// openFields decrypts the encrypted fields of a record read from disk, or
+// replaces them with null if the database has no field keys. It returns the
+// record as JSON and any error encountered.
+func (db *DB) openFields(tblName string, data []byte) ([]byte, error) {
+	fe := db.options(tblName).FieldEncryption
+	if fe == nil {
+		return data, nil
+	}
+
+	v, err := decodeJSONNumbers(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, ok := v.(map[string]interface{})
+	if !ok {
+		return data, nil
+	}
+
+	for _, fldName := range fe.Fields {
+		if !isSealedField(rec[fldName]) {
+			continue
+		}
+
+		if fe.Keys == nil {
+			rec[fldName] = nil
+			continue
+		}
+
+		rec[fldName], err = openField(fe.Keys, fldName, rec[fldName].(map[string]interface{}))
+		if err != nil {
+			return nil, fmt.Errorf("ivy: cannot decrypt field %s: %w", fldName, err)
+		}
+	}
+
+	return json.Marshal(rec)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// isSealedField answers whether a field value is an encrypted field object.
+func isSealedField(value interface{}) bool {
+	obj, ok := value.(map[string]interface{})
+	if !ok || len(obj) != 2 {
+		return false
+	}
+
+	_, ok = obj[encFieldData].(string)
+	if !ok {
+		return false
+	}
+	_, ok = obj[encFieldKey].(json.Number)
+
+	return ok
+}
+
+// openField decrypts an encrypted field object. It returns the field's value
+// and any error encountered.
+func openField(keys KeyProvider, fldName string, obj map[string]interface{}) (interface{}, error) {
+	version, err := obj[encFieldKey].(json.Number).Int64()
+	if err != nil || version < 0 || version > 1<<32-1 {
+		return nil, fmt.Errorf("ivy: bad key version %v", obj[encFieldKey])
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(obj[encFieldData].(string))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := keys.Key(uint32(version))
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ivy: encrypted field is truncated")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(fldName))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeJSONNumbers(plain)
+}
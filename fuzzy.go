@@ -0,0 +1,256 @@
+package ivy
+
+import (
+	"errors"
+	"sort"
+)
+
+// Type FuzzyMatch is a single candidate returned by a fuzzy field search.
+// Value is the indexed field value that matched, Distance is its edit distance
+// from the search value, and Ids are the record ids that have that value.
+type FuzzyMatch struct {
+	Value    string
+	Distance int
+	Ids      []string
+}
+
+// ErrFieldNotIndexed is returned by lookups that require an index on a field
+// that was not listed in fieldsToIndex when the database was opened.
+var ErrFieldNotIndexed = errors.New("ivy: field is not indexed")
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// FindFuzzyIdsForField returns the record ids whose value for an indexed field
+// is within a maximum edit distance of the supplied search value. It takes a
+// table name, a field name to search on, a value to search for and the maximum
+// Damerau-Levenshtein distance allowed. It returns the matches ranked by
+// distance (closest first) and any error encountered.
+func (db *DB) FindFuzzyIdsForField(tblName string, searchField string, searchValue string, maxDistance int) ([]FuzzyMatch, error) {
+	var matches []FuzzyMatch
+
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	tree, ok := db.fuzzyIndexes[tblName][searchField]
+	if !ok {
+		return nil, ErrFieldNotIndexed
+	}
+
+	for _, c := range tree.search(searchValue, maxDistance) {
+		ids := db.liveIds(tblName, db.fldIndexes[tblName][searchField][c.value])
+		if len(ids) > 0 {
+			matches = append(matches, FuzzyMatch{Value: c.value, Distance: c.distance, Ids: ids})
+		}
+	}
+
+	sort.Sort(byDistance(matches))
+
+	return matches, nil
+}
+
+// FindClosestValueForField answers the "did you mean" question for an indexed
+// field. It takes a table name, a field name and a search value, and returns the
+// closest indexed value within maxDistance, or an empty string if there is none.
+func (db *DB) FindClosestValueForField(tblName string, searchField string, searchValue string, maxDistance int) (string, error) {
+	matches, err := db.FindFuzzyIdsForField(tblName, searchField, searchValue, maxDistance)
+	if err != nil || len(matches) == 0 {
+		return "", err
+	}
+
+	return matches[0].Value, nil
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// initFuzzyIndexes builds a bk-tree over the keys of every field index of a
+// table. It must be called after the field indexes have been rebuilt.
+func (db *DB) initFuzzyIndexes(tblName string) {
+	trees := make(map[string]*bkTree)
+
+	for fldName, index := range db.fldIndexes[tblName] {
+		// The index of an encrypted field holds blind indexes, which are no use
+		// for fuzzy matching.
+		if db.encryptedField(tblName, fldName) {
+			continue
+		}
+
+		tree := new(bkTree)
+		for fldValue := range index {
+			tree.add(fldValue)
+		}
+		trees[fldName] = tree
+	}
+
+	db.fuzzyIndexes[tblName] = trees
+}
+
+//=============================================================================
+// BK-Tree
+//=============================================================================
+
+// bkTree is a Burkhard-Keller tree keyed on Damerau-Levenshtein distance. Since
+// that distance is a metric, the triangle inequality lets a search skip every
+// subtree whose edge distance is further than maxDistance from the query.
+type bkTree struct {
+	root *bkNode
+}
+
+type bkNode struct {
+	value    string
+	children map[int]*bkNode
+}
+
+type bkCandidate struct {
+	value    string
+	distance int
+}
+
+// add inserts a value into the tree, ignoring duplicates.
+func (t *bkTree) add(value string) {
+	if t.root == nil {
+		t.root = &bkNode{value: value}
+		return
+	}
+
+	node := t.root
+	for {
+		d := editDistance(node.value, value)
+		if d == 0 {
+			return
+		}
+
+		child, ok := node.children[d]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[int]*bkNode)
+			}
+			node.children[d] = &bkNode{value: value}
+			return
+		}
+		node = child
+	}
+}
+
+// search returns every value in the tree within maxDistance of value.
+func (t *bkTree) search(value string, maxDistance int) []bkCandidate {
+	var results []bkCandidate
+
+	if t.root == nil {
+		return nil
+	}
+
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		d := editDistance(node.value, value)
+		if d <= maxDistance {
+			results = append(results, bkCandidate{value: node.value, distance: d})
+		}
+
+		// Only children whose edge lies in [d-maxDistance, d+maxDistance] can hold
+		// values close enough to the query.
+		for edge, child := range node.children {
+			if edge >= d-maxDistance && edge <= d+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+
+	return results
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// editDistance returns the unrestricted Damerau-Levenshtein distance between
+// two strings, counting insertions, deletions, substitutions and transpositions
+// of adjacent runes.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	la, lb := len(ra), len(rb)
+
+	if la == 0 {
+		return lb
+	}
+	if lb == 0 {
+		return la
+	}
+
+	maxDist := la + lb
+
+	// d is a (la+2) x (lb+2) matrix, with the extra row and column holding the
+	// sentinel maxDist used by the transposition step.
+	d := make([][]int, la+2)
+	for i := range d {
+		d[i] = make([]int, lb+2)
+	}
+
+	d[0][0] = maxDist
+	for i := 0; i <= la; i++ {
+		d[i+1][0] = maxDist
+		d[i+1][1] = i
+	}
+	for j := 0; j <= lb; j++ {
+		d[0][j+1] = maxDist
+		d[1][j+1] = j
+	}
+
+	// lastRow records the last row in which each rune of a was seen.
+	lastRow := make(map[rune]int)
+
+	for i := 1; i <= la; i++ {
+		lastMatchCol := 0
+
+		for j := 1; j <= lb; j++ {
+			i1 := lastRow[rb[j-1]]
+			j1 := lastMatchCol
+
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+				lastMatchCol = j
+			}
+
+			d[i+1][j+1] = minInt(
+				d[i][j]+cost, // substitution
+				d[i+1][j]+1,  // insertion
+				d[i][j+1]+1,  // deletion
+				d[i1][j1]+(i-i1-1)+1+(j-j1-1), // transposition
+			)
+		}
+
+		lastRow[ra[i-1]] = i
+	}
+
+	return d[la+1][lb+1]
+}
+
+// minInt returns the smallest of its arguments.
+func minInt(first int, rest ...int) int {
+	m := first
+	for _, n := range rest {
+		if n < m {
+			m = n
+		}
+	}
+	return m
+}
+
+// byDistance sorts fuzzy matches by distance, then by value.
+type byDistance []FuzzyMatch
+
+func (m byDistance) Len() int      { return len(m) }
+func (m byDistance) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byDistance) Less(i, j int) bool {
+	if m[i].Distance != m[j].Distance {
+		return m[i].Distance < m[j].Distance
+	}
+	return m[i].Value < m[j].Value
+}
@@ -0,0 +1,373 @@
+package ivy
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// Type GeoIndex declares a geospatial index on a table. A point is read either
+// from a pair of numeric fields (LatField and LonField) or from a single field
+// holding a GeoJSON Point, e.g. {"type": "Point", "coordinates": [lon, lat]}.
+// Name identifies the index in queries; it defaults to PointField, or to
+// LatField and LonField joined by a comma.
+type GeoIndex struct {
+	Name       string
+	LatField   string
+	LonField   string
+	PointField string
+}
+
+// Type GeoMatch is a single result of a geospatial query. Distance is the
+// great-circle distance in meters from the query point, or zero for bounding
+// box queries.
+type GeoMatch struct {
+	Id       string
+	Lat      float64
+	Lon      float64
+	Distance float64
+}
+
+// ErrNoGeoIndex is returned by geospatial queries that name an index that was
+// not declared for the table.
+var ErrNoGeoIndex = errors.New("ivy: no such geo index")
+
+// earthRadius is the mean radius of the earth in meters.
+const earthRadius = 6371008.8
+
+// geoBits is the number of bits used for each coordinate of a geohash.
+const geoBits = 26
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// FindIdsWithinRadius returns all records whose point is within a radius of a
+// location. It takes a table name, a geo index name, a latitude and longitude
+// in degrees, and a radius in meters. It returns the matches sorted by distance
+// and any error encountered.
+func (db *DB) FindIdsWithinRadius(tblName string, indexName string, lat float64, lon float64, radius float64) ([]GeoMatch, error) {
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	idx, ok := db.geoIndexes[tblName][indexName]
+	if !ok {
+		return nil, ErrNoGeoIndex
+	}
+
+	return db.liveGeoMatches(tblName, idx.withinRadius(lat, lon, radius)), nil
+}
+
+// FindIdsWithinBox returns all records whose point lies inside a bounding box.
+// It takes a table name, a geo index name and the south-west and north-east
+// corners of the box in degrees. A box whose minLon is greater than its maxLon
+// is taken to cross the antimeridian. It returns the matches ordered by id and
+// any error encountered.
+func (db *DB) FindIdsWithinBox(tblName string, indexName string, minLat float64, minLon float64, maxLat float64, maxLon float64) ([]GeoMatch, error) {
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	idx, ok := db.geoIndexes[tblName][indexName]
+	if !ok {
+		return nil, ErrNoGeoIndex
+	}
+
+	matches := db.liveGeoMatches(tblName, idx.withinBox(minLat, minLon, maxLat, maxLon))
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Id < matches[j].Id })
+
+	return matches, nil
+}
+
+// FindNearestGeoIds returns the n records whose point is closest to a
+// location. It takes a table name, a geo index name, a latitude and longitude
+// in degrees, and the number of records wanted. It returns the matches sorted
+// by distance and any error encountered.
+func (db *DB) FindNearestGeoIds(tblName string, indexName string, lat float64, lon float64, n int) ([]GeoMatch, error) {
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	idx, ok := db.geoIndexes[tblName][indexName]
+	if !ok {
+		return nil, ErrNoGeoIndex
+	}
+
+	if n <= 0 || len(idx.points) == 0 {
+		return nil, nil
+	}
+
+	// Search ever wider circles until one holds at least n points. Every point
+	// inside the circle is found, so its n closest are the n closest overall.
+	var matches []GeoMatch
+	for radius := 1000.0; ; radius *= 4 {
+		matches = db.liveGeoMatches(tblName, idx.withinRadius(lat, lon, radius))
+		if len(matches) >= n || radius > math.Pi*earthRadius {
+			break
+		}
+	}
+
+	if len(matches) > n {
+		matches = matches[:n]
+	}
+
+	return matches, nil
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// geoIndex holds the points of a table sorted by geohash, so that every
+// geohash cell maps to a contiguous run of points.
+type geoIndex struct {
+	points []geoPoint
+}
+
+type geoPoint struct {
+	hash uint64
+	id   string
+	lat  float64
+	lon  float64
+}
+
+// initGeoIndexes initializes all geospatial indexes for a table.
+func (db *DB) initGeoIndexes(tblName string) error {
+	specs := db.options(tblName).GeoIndexes
+	indexes := make(map[string]*geoIndex)
+
+	for _, spec := range specs {
+		indexes[geoIndexName(spec)] = new(geoIndex)
+	}
+
+	// For every file in the data dir...
+	for _, fileId := range db.fileIdsInDataDir(tblName) {
+		rec, err := db.loadRecMap(tblName, fileId)
+		if err != nil {
+			return err
+		}
+
+		for _, spec := range specs {
+			if lat, lon, ok := geoPointOf(spec, rec); ok {
+				idx := indexes[geoIndexName(spec)]
+				idx.points = append(idx.points, geoPoint{geohash(lat, lon), fileId, lat, lon})
+			}
+		}
+	}
+
+	for _, idx := range indexes {
+		sort.Slice(idx.points, func(i, j int) bool { return idx.points[i].hash < idx.points[j].hash })
+	}
+
+	db.geoIndexes[tblName] = indexes
+
+	return nil
+}
+
+// update replaces the point of a record in the index, or removes the record if
+// ok is false, keeping the points sorted by geohash.
+func (idx *geoIndex) update(fileId string, lat, lon float64, ok bool) {
+	for i, p := range idx.points {
+		if p.id == fileId {
+			idx.points = append(idx.points[:i], idx.points[i+1:]...)
+			break
+		}
+	}
+
+	if !ok {
+		return
+	}
+
+	p := geoPoint{geohash(lat, lon), fileId, lat, lon}
+	i := sort.Search(len(idx.points), func(i int) bool { return idx.points[i].hash > p.hash })
+
+	idx.points = append(idx.points, geoPoint{})
+	copy(idx.points[i+1:], idx.points[i:])
+	idx.points[i] = p
+}
+
+// withinRadius returns the points within radius meters of a location, sorted
+// by distance.
+func (idx *geoIndex) withinRadius(lat, lon, radius float64) []GeoMatch {
+	var matches []GeoMatch
+
+	// Bound the circle by a box, then keep only the points truly inside it.
+	dLat := radius / earthRadius * 180 / math.Pi
+	minLat, maxLat := lat-dLat, lat+dLat
+	minLon, maxLon := -180.0, 180.0
+
+	if minLat > -90 && maxLat < 90 {
+		dLon := math.Asin(math.Min(1, math.Sin(radius/earthRadius)/math.Cos(lat*math.Pi/180))) * 180 / math.Pi
+		if radius < math.Pi/2*earthRadius && dLon < 180 {
+			minLon, maxLon = normalizeLon(lon-dLon), normalizeLon(lon+dLon)
+		}
+	}
+
+	for _, m := range idx.withinBox(math.Max(minLat, -90), minLon, math.Min(maxLat, 90), maxLon) {
+		m.Distance = haversine(lat, lon, m.Lat, m.Lon)
+		if m.Distance <= radius {
+			matches = append(matches, m)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Id < matches[j].Id
+	})
+
+	return matches
+}
+
+// withinBox returns the points inside a bounding box. Bounds beyond the poles
+// or the antimeridian are clamped to them.
+func (idx *geoIndex) withinBox(minLat, minLon, maxLat, maxLon float64) []GeoMatch {
+	minLat, maxLat = clamp(minLat, -90, 90), clamp(maxLat, -90, 90)
+	minLon, maxLon = clamp(minLon, -180, 180), clamp(maxLon, -180, 180)
+
+	if minLat > maxLat {
+		return nil
+	}
+
+	// Split a box that crosses the antimeridian in two.
+	if minLon > maxLon {
+		return append(idx.withinBox(minLat, minLon, maxLat, 180), idx.withinBox(minLat, -180, maxLat, maxLon)...)
+	}
+
+	var matches []GeoMatch
+
+	// Pick the finest cell size that covers the box with a handful of cells.
+	bits := uint(geoBits)
+	for bits > 0 && cellsPerSide(minLon, maxLon, -180, 360, bits)*cellsPerSide(minLat, maxLat, -90, 180, bits) > 16 {
+		bits--
+	}
+
+	x0, x1 := cellOf(minLon, -180, 360, bits), cellOf(maxLon, -180, 360, bits)
+	y0, y1 := cellOf(minLat, -90, 180, bits), cellOf(maxLat, -90, 180, bits)
+	shift := 2 * (geoBits - bits)
+
+	for x := x0; x <= x1; x++ {
+		for y := y0; y <= y1; y++ {
+			lo := interleave(x, y) << shift
+			hi := (interleave(x, y) + 1) << shift
+
+			i := sort.Search(len(idx.points), func(i int) bool { return idx.points[i].hash >= lo })
+			for ; i < len(idx.points) && idx.points[i].hash < hi; i++ {
+				p := idx.points[i]
+				if p.lat >= minLat && p.lat <= maxLat && p.lon >= minLon && p.lon <= maxLon {
+					matches = append(matches, GeoMatch{Id: p.id, Lat: p.lat, Lon: p.lon})
+				}
+			}
+		}
+	}
+
+	return matches
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// geoIndexName returns the name a geo index is queried by.
+func geoIndexName(spec GeoIndex) string {
+	switch {
+	case spec.Name != "":
+		return spec.Name
+	case spec.PointField != "":
+		return spec.PointField
+	default:
+		return spec.LatField + "," + spec.LonField
+	}
+}
+
+// geoPointOf extracts the point a geo index covers from a record.
+func geoPointOf(spec GeoIndex, rec map[string]interface{}) (float64, float64, bool) {
+	var lat, lon float64
+	var ok1, ok2 bool
+
+	if spec.PointField != "" {
+		point, ok := rec[spec.PointField].(map[string]interface{})
+		if !ok || point["type"] != "Point" {
+			return 0, 0, false
+		}
+		coords, ok := point["coordinates"].([]interface{})
+		if !ok || len(coords) < 2 {
+			return 0, 0, false
+		}
+		lon, ok1 = coords[0].(float64)
+		lat, ok2 = coords[1].(float64)
+	} else {
+		lat, ok1 = rec[spec.LatField].(float64)
+		lon, ok2 = rec[spec.LonField].(float64)
+	}
+
+	if !ok1 || !ok2 || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+
+	return lat, lon, true
+}
+
+// geohash interleaves the bits of a quantized longitude and latitude into a
+// single integer, so that nearby points usually share a long prefix.
+func geohash(lat, lon float64) uint64 {
+	return interleave(cellOf(lon, -180, 360, geoBits), cellOf(lat, -90, 180, geoBits))
+}
+
+// cellOf returns the cell a coordinate falls in when its range is split into
+// 2^bits cells. Coordinates outside the range fall in the first or last cell.
+func cellOf(v, min, span float64, bits uint) uint64 {
+	n := uint64(1) << bits
+	if v <= min {
+		return 0
+	}
+
+	c := uint64((v - min) / span * float64(n))
+	if c >= n {
+		c = n - 1
+	}
+	return c
+}
+
+// clamp limits v to the range [lo, hi].
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
+
+// cellsPerSide returns how many cells of size span/2^bits a range covers.
+func cellsPerSide(lo, hi, min, span float64, bits uint) uint64 {
+	return cellOf(hi, min, span, bits) - cellOf(lo, min, span, bits) + 1
+}
+
+// interleave spreads the bits of x and y so that x takes the odd positions and
+// y the even ones.
+func interleave(x, y uint64) uint64 {
+	var h uint64
+	for i := uint(0); i < geoBits; i++ {
+		h |= (x>>i&1)<<(2*i+1) | (y>>i&1)<<(2*i)
+	}
+	return h
+}
+
+// haversine returns the great-circle distance in meters between two points.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	const rad = math.Pi / 180
+
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// normalizeLon wraps a longitude into [-180, 180].
+func normalizeLon(lon float64) float64 {
+	for lon > 180 {
+		lon -= 360
+	}
+	for lon < -180 {
+		lon += 360
+	}
+	return lon
+}
@@ -0,0 +1,250 @@
+package ivy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyDir is the name of the directory, inside a table directory, that
+// holds the revisions of records in tables with TableOptions.History set. Each
+// record gets a sub directory named after its id, holding one file per
+// revision named <rev>-<unix nanoseconds>.rev, or .del for a deletion.
+const historyDir = "_history"
+
+// Type Revision describes one saved version of a record. Rev counts up from 1
+// for each record, Time is when the version was written and Deleted marks the
+// revision at which the record was deleted.
+type Revision struct {
+	Rev     int
+	Time    time.Time
+	Deleted bool
+}
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// History lists the saved revisions of a record.
+// It takes a table name and the record id. It returns the revisions from
+// oldest to newest and any error encountered.
+func (db *DB) History(tblName string, fileId string) ([]Revision, error) {
+	if !validFileId(fileId) {
+		return nil, ErrInvalidId
+	}
+
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	revs, _ := db.revisions(tblName, fileId)
+
+	return revs, nil
+}
+
+// FindAtRevision loads up a Record struct with a saved revision of a record.
+// It takes a table name, a pointer to a Record struct, the record id and the
+// revision number. It returns ErrNotFound if there is no such revision or the
+// record was deleted at that revision, or any other error encountered.
+func (db *DB) FindAtRevision(tblName string, rec Record, fileId string, rev int) error {
+	if !validFileId(fileId) {
+		return ErrInvalidId
+	}
+
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	revs, _ := db.revisions(tblName, fileId)
+	for _, r := range revs {
+		if r.Rev == rev {
+			return db.loadRevision(tblName, rec, fileId, r)
+		}
+	}
+
+	return ErrNotFound
+}
+
+// FindAsOf loads up a Record struct with a record as it was at a point in time.
+// It takes a table name, a pointer to a Record struct, the record id and the
+// time. It returns ErrNotFound if the record did not exist at that time, or
+// any other error encountered.
+func (db *DB) FindAsOf(tblName string, rec Record, fileId string, asOf time.Time) error {
+	if !validFileId(fileId) {
+		return ErrInvalidId
+	}
+
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	revs, _ := db.revisions(tblName, fileId)
+	for i := len(revs) - 1; i >= 0; i-- {
+		if !revs[i].Time.After(asOf) {
+			return db.loadRevision(tblName, rec, fileId, revs[i])
+		}
+	}
+
+	return ErrNotFound
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// saveRevision appends a revision holding a record's stored contents, with
+// its encrypted fields sealed, or a deletion marker if data is nil, and then
+// applies the table's retention limits. The caller must hold the table's
+// write lock.
+func (db *DB) saveRevision(tblName string, fileId string, data []byte) error {
+	dir := db.historyPath(tblName, fileId)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	revs, err := db.revisions(tblName, fileId)
+	if err != nil {
+		return err
+	}
+
+	next := Revision{Rev: 1, Time: time.Now(), Deleted: data == nil}
+	if len(revs) > 0 {
+		last := revs[len(revs)-1]
+		next.Rev = last.Rev + 1
+
+		// Keep revision times strictly increasing, even on coarse clocks.
+		if !next.Time.After(last.Time) {
+			next.Time = last.Time.Add(time.Nanosecond)
+		}
+	}
+
+	if data != nil {
+		data, err = db.encrypt(tblName, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, revisionFileName(next)), data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return db.pruneHistory(tblName, fileId, append(revs, next))
+}
+
+// pruneHistory removes the revisions of a record that fall outside the table's
+// retention limits. The newest revision is always kept.
+func (db *DB) pruneHistory(tblName string, fileId string, revs []Revision) error {
+	opts := db.options(tblName)
+	dir := db.historyPath(tblName, fileId)
+
+	for i, r := range revs[:len(revs)-1] {
+		tooMany := opts.HistoryLimit > 0 && len(revs)-i > opts.HistoryLimit
+		tooOld := opts.HistoryMaxAge > 0 && time.Since(r.Time) > opts.HistoryMaxAge
+
+		if tooMany || tooOld {
+			err := os.Remove(path.Join(dir, revisionFileName(r)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// revisions lists the saved revisions of a record, oldest first.
+func (db *DB) revisions(tblName string, fileId string) ([]Revision, error) {
+	var revs []Revision
+
+	files, err := ioutil.ReadDir(db.historyPath(tblName, fileId))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if r, ok := parseRevisionFileName(file.Name()); ok {
+			revs = append(revs, r)
+		}
+	}
+
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Rev < revs[j].Rev })
+
+	return revs, nil
+}
+
+// loadRevision reads a saved revision into a Record struct.
+func (db *DB) loadRevision(tblName string, rec Record, fileId string, r Revision) error {
+	if r.Deleted {
+		return ErrNotFound
+	}
+
+	data, err := ioutil.ReadFile(path.Join(db.historyPath(tblName, fileId), revisionFileName(r)))
+	if err != nil {
+		return err
+	}
+
+	data, err = db.decrypt(tblName, data)
+	if err != nil {
+		return err
+	}
+
+	data, err = db.openFields(tblName, data)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, rec)
+	if err != nil {
+		return err
+	}
+
+	rec.AfterFind(db, fileId)
+
+	return nil
+}
+
+// historyPath returns the directory holding the revisions of a record.
+func (db *DB) historyPath(tblName string, fileId string) string {
+	return path.Join(db.tblPath(tblName), historyDir, fileId)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// revisionFileName returns the file name a revision is stored under.
+func revisionFileName(r Revision) string {
+	ext := ".rev"
+	if r.Deleted {
+		ext = ".del"
+	}
+	return fmt.Sprintf("%d-%d%s", r.Rev, r.Time.UnixNano(), ext)
+}
+
+// parseRevisionFileName is the inverse of revisionFileName.
+func parseRevisionFileName(name string) (Revision, bool) {
+	ext := path.Ext(name)
+	if ext != ".rev" && ext != ".del" {
+		return Revision{}, false
+	}
+
+	parts := strings.SplitN(strings.TrimSuffix(name, ext), "-", 2)
+	if len(parts) != 2 {
+		return Revision{}, false
+	}
+
+	rev, err1 := strconv.Atoi(parts[0])
+	nanos, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return Revision{}, false
+	}
+
+	return Revision{Rev: rev, Time: time.Unix(0, nanos), Deleted: ext == ".del"}, true
+}
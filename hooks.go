@@ -0,0 +1,172 @@
+package ivy
+
+// The optional hook interfaces below may be implemented by the structs passed
+// to Create, CreateWithId, CreateMany, Insert, Replace, Upsert and Update, and
+// the delete hooks by the struct passed to DeleteRecord, which loads the record
+// into it first. Delete only has an id, so it runs the table hooks alone, as do
+// the deletes a Cascade reference causes. The interfaces are detected by type
+// assertion, so the struct must be passed by pointer if its hook methods have
+// pointer receivers. Before hooks and Validate run with
+// the table's write lock held and must not call back into the database for the
+// same table; returning an error from one of them aborts the write. After hooks
+// run once the lock has been released.
+
+// Type BeforeCreator is implemented by records that want to run code, such as
+// setting a timestamp, before they are first written.
+type BeforeCreator interface {
+	BeforeCreate(*DB, string) error
+}
+
+// Type AfterCreator is implemented by records that want to run code after they
+// have been created.
+type AfterCreator interface {
+	AfterCreate(*DB, string)
+}
+
+// Type BeforeUpdater is implemented by records that want to run code before an
+// existing record is overwritten with them.
+type BeforeUpdater interface {
+	BeforeUpdate(*DB, string) error
+}
+
+// Type AfterUpdater is implemented by records that want to run code after an
+// existing record has been overwritten with them.
+type AfterUpdater interface {
+	AfterUpdate(*DB, string)
+}
+
+// Type BeforeDeleter is implemented by records that want to run code before
+// they are deleted with DeleteRecord.
+type BeforeDeleter interface {
+	BeforeDelete(*DB, string) error
+}
+
+// Type AfterDeleter is implemented by records that want to run code after they
+// have been deleted with DeleteRecord.
+type AfterDeleter interface {
+	AfterDelete(*DB, string)
+}
+
+// Type Validator is implemented by records that check themselves before every
+// write.
+type Validator interface {
+	Validate() error
+}
+
+// Type Hooks holds callbacks registered for a whole table through
+// TableOptions. They run for every write to the table, including Patch and the
+// field operators, which pass the record as a map[string]interface{}. Table
+// hooks run after the record's own hooks. Any field may be left nil.
+type Hooks struct {
+	BeforeCreate func(db *DB, tblName string, fileId string, rec interface{}) error
+	AfterCreate  func(db *DB, tblName string, fileId string, rec interface{})
+	BeforeUpdate func(db *DB, tblName string, fileId string, rec interface{}) error
+	AfterUpdate  func(db *DB, tblName string, fileId string, rec interface{})
+	BeforeDelete func(db *DB, tblName string, fileId string) error
+	AfterDelete  func(db *DB, tblName string, fileId string)
+	Validate     func(tblName string, rec interface{}) error
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// beforeWrite runs the before-create or before-update hooks and then the
+// validation hooks for a record about to be written.
+func (db *DB) beforeWrite(tblName string, fileId string, rec interface{}, creating bool) error {
+	hooks := db.options(tblName).Hooks
+
+	if creating {
+		if r, ok := rec.(BeforeCreator); ok {
+			if err := r.BeforeCreate(db, fileId); err != nil {
+				return err
+			}
+		}
+		if hooks != nil && hooks.BeforeCreate != nil {
+			if err := hooks.BeforeCreate(db, tblName, fileId, rec); err != nil {
+				return err
+			}
+		}
+	} else {
+		if r, ok := rec.(BeforeUpdater); ok {
+			if err := r.BeforeUpdate(db, fileId); err != nil {
+				return err
+			}
+		}
+		if hooks != nil && hooks.BeforeUpdate != nil {
+			if err := hooks.BeforeUpdate(db, tblName, fileId, rec); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r, ok := rec.(Validator); ok {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	if hooks != nil && hooks.Validate != nil {
+		if err := hooks.Validate(tblName, rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// afterWrite runs the after-create or after-update hooks for a record that has
+// been written.
+func (db *DB) afterWrite(tblName string, fileId string, rec interface{}, created bool) {
+	hooks := db.options(tblName).Hooks
+
+	if created {
+		if r, ok := rec.(AfterCreator); ok {
+			r.AfterCreate(db, fileId)
+		}
+		if hooks != nil && hooks.AfterCreate != nil {
+			hooks.AfterCreate(db, tblName, fileId, rec)
+		}
+	} else {
+		if r, ok := rec.(AfterUpdater); ok {
+			r.AfterUpdate(db, fileId)
+		}
+		if hooks != nil && hooks.AfterUpdate != nil {
+			hooks.AfterUpdate(db, tblName, fileId, rec)
+		}
+	}
+}
+
+// hasAfterCreate answers whether any after-create hook would run for a record,
+// so callers can avoid holding on to records that need no hook.
+func (db *DB) hasAfterCreate(tblName string, rec interface{}) bool {
+	if _, ok := rec.(AfterCreator); ok {
+		return true
+	}
+	hooks := db.options(tblName).Hooks
+	return hooks != nil && hooks.AfterCreate != nil
+}
+
+// beforeDelete runs the before-delete hooks for a record about to be deleted.
+// rec is the record loaded by DeleteRecord, or nil.
+func (db *DB) beforeDelete(tblName string, fileId string, rec interface{}) error {
+	if r, ok := rec.(BeforeDeleter); ok {
+		if err := r.BeforeDelete(db, fileId); err != nil {
+			return err
+		}
+	}
+	if hooks := db.options(tblName).Hooks; hooks != nil && hooks.BeforeDelete != nil {
+		return hooks.BeforeDelete(db, tblName, fileId)
+	}
+	return nil
+}
+
+// afterDelete runs the after-delete hooks for a record that has been deleted.
+// rec is the record loaded by DeleteRecord, or nil.
+func (db *DB) afterDelete(tblName string, fileId string, rec interface{}) {
+	if r, ok := rec.(AfterDeleter); ok {
+		r.AfterDelete(db, fileId)
+	}
+	if hooks := db.options(tblName).Hooks; hooks != nil && hooks.AfterDelete != nil {
+		hooks.AfterDelete(db, tblName, fileId)
+	}
+}
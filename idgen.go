@@ -0,0 +1,283 @@
+package ivy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type IdGenerator allocates ids for new records. Pick one per table with
+// TableOptions.IdGenerator; tables without one keep the original behaviour of
+// using one more than the highest numeric id in the table.
+//
+// NextId is called with the table's write lock held, so it must not call back
+// into the database for the same table.
+type IdGenerator interface {
+	// NextId returns a new id for a record in the table stored at tblPath.
+	NextId(tblPath string) (string, error)
+}
+
+// sequenceFile is the name of the file a sequence generator persists its last
+// id in, inside the table directory.
+const sequenceFile = ".sequence"
+
+//=============================================================================
+// Sequence
+//=============================================================================
+
+// NewSequenceGenerator returns a generator of ascending numeric ids that are
+// never reused, even after the record with the highest id is deleted. The last
+// id handed out is persisted in the table directory; the first time a table is
+// used the sequence starts after its highest existing numeric id.
+func NewSequenceGenerator() IdGenerator {
+	return &sequenceGenerator{last: make(map[string]int)}
+}
+
+type sequenceGenerator struct {
+	mu   sync.Mutex
+	last map[string]int
+}
+
+func (g *sequenceGenerator) NextId(tblPath string) (string, error) {
+	return g.next(tblPath, nil)
+}
+
+// next returns the next id in a table's sequence. If nothing has been
+// persisted yet the sequence starts after the highest of the ids returned by
+// liveIds, or of the record files in tblPath if liveIds is nil.
+func (g *sequenceGenerator) next(tblPath string, liveIds func() []string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	last, ok := g.last[tblPath]
+	if !ok {
+		var err error
+
+		last, err = readSequence(tblPath, liveIds)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	next := last + 1
+
+	err := writeSequence(tblPath, next)
+	if err != nil {
+		return "", err
+	}
+
+	g.last[tblPath] = next
+
+	return strconv.Itoa(next), nil
+}
+
+// readSequence returns the last id persisted for a table, or its highest
+// existing numeric id, counting soft deleted records, if nothing has been
+// persisted yet. The live ids come from liveIds if it is not nil.
+func readSequence(tblPath string, liveIds func() []string) (int, error) {
+	data, err := ioutil.ReadFile(path.Join(tblPath, sequenceFile))
+	if err == nil {
+		return strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	var names []string
+
+	if liveIds != nil {
+		names = liveIds()
+	} else {
+		files, err := ioutil.ReadDir(tblPath)
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+	}
+
+	trashed, _ := ioutil.ReadDir(path.Join(tblPath, trashDir))
+	for _, file := range trashed {
+		names = append(names, file.Name())
+	}
+
+	highest := 0
+
+	for _, name := range names {
+		if n, err := strconv.Atoi(strings.TrimSuffix(name, path.Ext(name))); err == nil && n > highest {
+			highest = n
+		}
+	}
+
+	return highest, nil
+}
+
+// writeSequence persists the last id handed out for a table, replacing the old
+// value atomically.
+func writeSequence(tblPath string, last int) error {
+	filename := path.Join(tblPath, sequenceFile)
+
+	err := ioutil.WriteFile(filename+".tmp", []byte(strconv.Itoa(last)), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
+
+//=============================================================================
+// UUID
+//=============================================================================
+
+// NewUUIDv4Generator returns a generator of random (version 4) UUIDs, in the
+// canonical hyphenated lower-case form.
+func NewUUIDv4Generator() IdGenerator {
+	return uuidGenerator{version: 4}
+}
+
+// NewUUIDv7Generator returns a generator of time-ordered (version 7) UUIDs,
+// whose first 48 bits are the Unix time in milliseconds.
+func NewUUIDv7Generator() IdGenerator {
+	return uuidGenerator{version: 7}
+}
+
+type uuidGenerator struct {
+	version byte
+}
+
+func (g uuidGenerator) NextId(tblPath string) (string, error) {
+	var u [16]byte
+
+	_, err := rand.Read(u[:])
+	if err != nil {
+		return "", err
+	}
+
+	if g.version == 7 {
+		ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+		var ts [8]byte
+		binary.BigEndian.PutUint64(ts[:], ms)
+		copy(u[:6], ts[2:])
+	}
+
+	u[6] = u[6]&0x0f | g.version<<4
+	u[8] = u[8]&0x3f | 0x80
+
+	h := hex.EncodeToString(u[:])
+
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+//=============================================================================
+// ULID
+//=============================================================================
+
+// crockford is the Crockford base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULIDGenerator returns a generator of ULIDs: 26 character, lexically
+// sortable ids made of a 48 bit millisecond timestamp and 80 random bits. Ids
+// generated within the same millisecond increment the random part, so they
+// still sort in creation order.
+func NewULIDGenerator() IdGenerator {
+	return &ulidGenerator{}
+}
+
+type ulidGenerator struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	lastRnd [10]byte
+}
+
+func (g *ulidGenerator) NextId(tblPath string) (string, error) {
+	var u [16]byte
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+
+	if ms <= g.lastMs {
+		// Same (or an earlier) millisecond: bump the previous random part.
+		ms = g.lastMs
+		for i := len(g.lastRnd) - 1; i >= 0; i-- {
+			g.lastRnd[i]++
+			if g.lastRnd[i] != 0 {
+				break
+			}
+		}
+	} else {
+		_, err := rand.Read(g.lastRnd[:])
+		if err != nil {
+			return "", err
+		}
+	}
+	g.lastMs = ms
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], ms)
+	copy(u[:6], ts[2:])
+	copy(u[6:], g.lastRnd[:])
+
+	// 128 bits encode to 26 characters of 5 bits each, with two leading zero
+	// bits.
+	n := new(big.Int).SetBytes(u[:])
+	id := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		id[i] = crockford[new(big.Int).And(n, big.NewInt(31)).Int64()]
+		n.Rsh(n, 5)
+	}
+
+	return string(id), nil
+}
+
+//=============================================================================
+// KSUID
+//=============================================================================
+
+// ksuidEpoch is the KSUID epoch, 2014-05-13 16:53:20 UTC, in Unix seconds.
+const ksuidEpoch = 1400000000
+
+// base62 is the alphabet used by KSUIDs.
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// NewKSUIDGenerator returns a generator of KSUIDs: 27 character, roughly
+// time-ordered ids made of a 32 bit timestamp and 128 random bits, encoded in
+// base62.
+func NewKSUIDGenerator() IdGenerator {
+	return ksuidGenerator{}
+}
+
+type ksuidGenerator struct{}
+
+func (g ksuidGenerator) NextId(tblPath string) (string, error) {
+	var k [20]byte
+
+	binary.BigEndian.PutUint32(k[:4], uint32(time.Now().Unix()-ksuidEpoch))
+
+	_, err := rand.Read(k[4:])
+	if err != nil {
+		return "", err
+	}
+
+	n := new(big.Int).SetBytes(k[:])
+	base := big.NewInt(62)
+	rem := new(big.Int)
+
+	id := make([]byte, 27)
+	for i := 26; i >= 0; i-- {
+		n.DivMod(n, base, rem)
+		id[i] = base62[rem.Int64()]
+	}
+
+	return string(id), nil
+}
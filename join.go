@@ -0,0 +1,265 @@
+package ivy
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Type JoinKind says what happens to records that have no related records in
+// a join.
+type JoinKind int
+
+const (
+	InnerJoin JoinKind = iota // drop records with no related records
+	LeftJoin                  // keep records with no related records
+)
+
+// Type Join describes how the records of a table relate to the records of
+// another table. A record is related to every record in Table whose On field
+// holds one of the values of its own Field. An empty Field or On stands for
+// the record id, so
+//
+//	ivy.Join{Table: "planes", Field: "plane_id"}
+//
+// follows a reference from a flight to its plane, and
+//
+//	ivy.Join{Table: "flights", On: "plane_id"}
+//
+// finds the flights of a plane. Field may hold a single value or an array of
+// values. On must be the record id, a field listed in fieldsToIndex or a
+// field with a Reference. The related records are reported under As, which
+// defaults to Table.
+type Join struct {
+	Table string
+	Field string
+	On    string
+	As    string
+	Kind  JoinKind
+}
+
+// Type JoinedRecord is a record returned by FindJoined, together with its
+// related records keyed by the As name of each join.
+type JoinedRecord struct {
+	Id      string
+	Record  map[string]interface{}
+	Related map[string][]JoinedRecord
+}
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// FindJoined returns records of a table together with their related records
+// from other tables. It takes a table name, the ids of the records to return,
+// or nil for every record in the table, and the joins to apply. Records are
+// returned in the order of ids, less any dropped by an inner join. It returns
+// ErrFieldNotIndexed if a join's On field is not indexed, or any other error
+// encountered.
+func (db *DB) FindJoined(tblName string, ids []string, joins ...Join) ([]JoinedRecord, error) {
+	var recs []JoinedRecord
+
+	unlock := db.joinLocks(tblName, joins)
+	defer unlock()
+
+	if ids == nil {
+		ids = db.liveIds(tblName, db.fileIdsInDataDir(tblName))
+	}
+
+	for _, fileId := range ids {
+		if !validFileId(fileId) {
+			return nil, ErrInvalidId
+		}
+
+		if db.isExpired(tblName, fileId) {
+			continue
+		}
+
+		rec, err := db.loadRecMap(tblName, fileId)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		related, keep, err := db.related(fileId, rec, joins)
+		if err != nil {
+			return nil, err
+		}
+
+		if keep {
+			recs = append(recs, JoinedRecord{Id: fileId, Record: rec, Related: related})
+		}
+	}
+
+	return recs, nil
+}
+
+// FindWithRelated loads up a Record struct with a record and its related
+// records, in one call. It takes a table name, a pointer to a Record struct,
+// the record id and the joins to apply. The related records of each join are
+// decoded into the struct field whose json name is the join's As name: as a
+// single record when the join follows a single-valued Field to record ids, and
+// as an array otherwise. It returns ErrNotFound if an inner join finds no
+// related records, or any error encountered.
+func (db *DB) FindWithRelated(tblName string, rec Record, fileId string, joins ...Join) error {
+	if !validFileId(fileId) {
+		return ErrInvalidId
+	}
+
+	unlock := db.joinLocks(tblName, joins)
+	defer unlock()
+
+	if db.isExpired(tblName, fileId) {
+		return db.notFoundErr(tblName, fileId)
+	}
+
+	doc, err := db.loadRecMap(tblName, fileId)
+	if err != nil {
+		return err
+	}
+
+	related, keep, err := db.related(fileId, doc, joins)
+	if err != nil {
+		return err
+	}
+
+	if !keep {
+		return ErrNotFound
+	}
+
+	for _, join := range joins {
+		var values []interface{}
+
+		for _, r := range related[join.name()] {
+			values = append(values, r.Record)
+		}
+
+		_, multi := doc[join.Field].([]interface{})
+
+		if join.On == "" && join.Field != "" && !multi {
+			doc[join.name()] = nil
+			if len(values) > 0 {
+				doc[join.name()] = values[0]
+			}
+		} else {
+			if values == nil {
+				values = []interface{}{}
+			}
+			doc[join.name()] = values
+		}
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, rec)
+	if err != nil {
+		return err
+	}
+
+	rec.AfterFind(db, fileId)
+
+	return nil
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// joinLocks read locks a table and every table it is joined to. It returns a
+// function that releases the locks.
+func (db *DB) joinLocks(tblName string, joins []Join) func() {
+	tblNames := []string{tblName}
+
+	for _, join := range joins {
+		tblNames = append(tblNames, join.Table)
+	}
+
+	return db.lockTbls(nil, tblNames)
+}
+
+// related finds the related records of a record for each join. It returns the
+// related records keyed by join name, whether the record survives the inner
+// joins and any error encountered.
+func (db *DB) related(fileId string, rec map[string]interface{}, joins []Join) (map[string][]JoinedRecord, bool, error) {
+	related := make(map[string][]JoinedRecord)
+	keep := true
+
+	for _, join := range joins {
+		keys := []string{fileId}
+		if join.Field != "" {
+			keys = refIds(rec[join.Field])
+		}
+
+		var matches []JoinedRecord
+		seen := make(map[string]bool)
+
+		for _, key := range keys {
+			ids, err := db.joinIds(join, key)
+			if err != nil {
+				return nil, false, err
+			}
+
+			for _, id := range ids {
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+
+				relRec, err := db.loadRecMap(join.Table, id)
+				if os.IsNotExist(err) {
+					continue
+				}
+				if err != nil {
+					return nil, false, err
+				}
+
+				matches = append(matches, JoinedRecord{Id: id, Record: relRec})
+			}
+		}
+
+		if len(matches) == 0 && join.Kind == InnerJoin {
+			keep = false
+		}
+
+		related[join.name()] = matches
+	}
+
+	return related, keep, nil
+}
+
+// joinIds returns the ids of the live records of a join's table whose On
+// field holds a value.
+func (db *DB) joinIds(join Join, value string) ([]string, error) {
+	if join.On == "" {
+		if validFileId(value) && db.recExists(join.Table, value) && !db.isExpired(join.Table, value) {
+			return []string{value}, nil
+		}
+		return nil, nil
+	}
+
+	if index, ok := db.fldIndexes[join.Table][join.On]; ok {
+		return db.liveIds(join.Table, index[db.indexKey(join.Table, join.On, value)]), nil
+	}
+
+	if index, ok := db.refIndexes[join.Table][join.On]; ok {
+		return db.liveIds(join.Table, index[value]), nil
+	}
+
+	return nil, ErrFieldNotIndexed
+}
+
+//*****************************************************************************
+// Private Join Methods
+//*****************************************************************************
+
+// name returns the name a join's related records are reported under.
+func (join Join) name() string {
+	if join.As != "" {
+		return join.As
+	}
+	return join.Table
+}
@@ -0,0 +1,345 @@
+package ivy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// errMsgpackShort is returned when MessagePack data ends in the middle of a
+// value.
+var errMsgpackShort = errors.New("ivy: msgpack data is truncated")
+
+//=============================================================================
+// MessagePack
+//=============================================================================
+
+// NewMessagePackCodec returns a codec that stores records as MessagePack in
+// .msgpack files. Integers that fit in 64 bits are stored as MessagePack
+// integers and all other numbers as 64-bit floats. Map keys are written in
+// sorted order, so equal records encode to equal bytes.
+func NewMessagePackCodec() Codec {
+	return msgpackCodec{}
+}
+
+type msgpackCodec struct{}
+
+func (c msgpackCodec) Ext() string {
+	return ".msgpack"
+}
+
+func (c msgpackCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	v, err := decodeJSONNumbers(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeMsgpack(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c msgpackCodec) Decode(data []byte) ([]byte, error) {
+	v, rest, err := readMsgpack(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("ivy: %d bytes of trailing msgpack data", len(rest))
+	}
+
+	return json.Marshal(v)
+}
+
+// writeMsgpack appends the MessagePack encoding of a decoded JSON value.
+func writeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if t {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(t.String(), 10, 64); err == nil {
+			writeMsgpackInt(buf, i)
+		} else if u, err := strconv.ParseUint(t.String(), 10, 64); err == nil {
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, u)
+		} else {
+			f, err := t.Float64()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		writeMsgpackHeader(buf, len(t), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(t)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(t), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, x := range t {
+			if err := writeMsgpack(buf, x); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		writeMsgpackHeader(buf, len(t), 0x80, 15, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			writeMsgpack(buf, k)
+			if err := writeMsgpack(buf, t[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("ivy: cannot encode %T as msgpack", v)
+	}
+
+	return nil
+}
+
+// writeMsgpackInt appends the smallest MessagePack encoding of an integer.
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		buf.WriteByte(byte(i))
+	case i >= -32 && i < 0:
+		buf.WriteByte(byte(int8(i)))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// writeMsgpackHeader appends the header of a string, array or map of length
+// n, using the fix form below fixMax and the 8, 16 or 32-bit forms otherwise.
+// A zero code8 means the type has no 8-bit form.
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, code8 byte, code16 byte, code32 byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// readMsgpack decodes one MessagePack value into a JSON value. It returns the
+// value, the data that follows it and any error encountered. Binary values
+// are decoded as strings; extension types are not supported.
+func readMsgpack(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errMsgpackShort
+	}
+
+	code, data := data[0], data[1:]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), data, nil
+	case code >= 0xe0:
+		return int64(int8(code)), data, nil
+	case code&0xf0 == 0x80:
+		return readMsgpackMap(data, int(code&0x0f))
+	case code&0xf0 == 0x90:
+		return readMsgpackArray(data, int(code&0x0f))
+	case code&0xe0 == 0xa0:
+		return readMsgpackString(data, int(code&0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, data, nil
+	case 0xc2:
+		return false, data, nil
+	case 0xc3:
+		return true, data, nil
+	case 0xc4, 0xd9:
+		n, data, err := readMsgpackUint(data, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackString(data, int(n))
+	case 0xc5, 0xda:
+		n, data, err := readMsgpackUint(data, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackString(data, int(n))
+	case 0xc6, 0xdb:
+		n, data, err := readMsgpackUint(data, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackString(data, int(n))
+	case 0xca:
+		bits, data, err := readMsgpackUint(data, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return float64(math.Float32frombits(uint32(bits))), data, nil
+	case 0xcb:
+		bits, data, err := readMsgpackUint(data, 8)
+		if err != nil {
+			return nil, nil, err
+		}
+		return math.Float64frombits(bits), data, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, data, err := readMsgpackUint(data, 1<<(code-0xcc))
+		if err != nil {
+			return nil, nil, err
+		}
+		return u, data, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		u, data, err := readMsgpackUint(data, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Sign extend from the encoded width.
+		shift := uint(64 - 8*size)
+		return int64(u<<shift) >> shift, data, nil
+	case 0xdc:
+		n, data, err := readMsgpackUint(data, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackArray(data, int(n))
+	case 0xdd:
+		n, data, err := readMsgpackUint(data, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackArray(data, int(n))
+	case 0xde:
+		n, data, err := readMsgpackUint(data, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackMap(data, int(n))
+	case 0xdf:
+		n, data, err := readMsgpackUint(data, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackMap(data, int(n))
+	}
+
+	return nil, nil, fmt.Errorf("ivy: unsupported msgpack type 0x%02x", code)
+}
+
+// readMsgpackUint reads a big endian unsigned integer of size bytes.
+func readMsgpackUint(data []byte, size int) (uint64, []byte, error) {
+	if len(data) < size {
+		return 0, nil, errMsgpackShort
+	}
+
+	var u uint64
+	for _, b := range data[:size] {
+		u = u<<8 | uint64(b)
+	}
+
+	return u, data[size:], nil
+}
+
+// readMsgpackString reads n bytes as a string.
+func readMsgpackString(data []byte, n int) (interface{}, []byte, error) {
+	if n < 0 || len(data) < n {
+		return nil, nil, errMsgpackShort
+	}
+	return string(data[:n]), data[n:], nil
+}
+
+// readMsgpackArray reads n values into an array.
+func readMsgpackArray(data []byte, n int) (interface{}, []byte, error) {
+	if n < 0 || n > len(data) {
+		return nil, nil, errMsgpackShort
+	}
+
+	arr := make([]interface{}, n)
+	for i := range arr {
+		var err error
+
+		arr[i], data, err = readMsgpack(data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return arr, data, nil
+}
+
+// readMsgpackMap reads n key and value pairs into a map. Keys must be strings.
+func readMsgpackMap(data []byte, n int) (interface{}, []byte, error) {
+	if n < 0 || n > len(data) {
+		return nil, nil, errMsgpackShort
+	}
+
+	obj := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		var k, v interface{}
+		var err error
+
+		k, data, err = readMsgpack(data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key, ok := k.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("ivy: msgpack map key %v is not a string", k)
+		}
+
+		v, data, err = readMsgpack(data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		obj[key] = v
+	}
+
+	return obj, data, nil
+}
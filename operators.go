@@ -0,0 +1,178 @@
+package ivy
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// ErrFieldType is returned by the field operators when a field holds a value of
+// the wrong type for the operation, such as incrementing a string.
+var ErrFieldType = errors.New("ivy: field has the wrong type")
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// Inc atomically adds a number to a numeric field of a record.
+// It takes a table name, the record id, the field name and the amount to add.
+// A missing field counts as zero. It returns the new value and any error
+// encountered.
+func (db *DB) Inc(tblName string, fileId string, field string, n float64) (float64, error) {
+	var result float64
+
+	err := db.mutate(tblName, fileId, func(rec map[string]interface{}) error {
+		current := 0.0
+
+		if v, ok := rec[field]; ok && v != nil {
+			f, ok := v.(float64)
+			if !ok {
+				return ErrFieldType
+			}
+			current = f
+		}
+
+		result = current + n
+		rec[field] = result
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// Push atomically appends a value to an array field of a record.
+// It takes a table name, the record id, the field name and the value to
+// append. A missing field is created as a new array. It returns any error
+// encountered.
+func (db *DB) Push(tblName string, fileId string, field string, v interface{}) error {
+	value, err := toJSONValue(v)
+	if err != nil {
+		return err
+	}
+
+	return db.mutate(tblName, fileId, func(rec map[string]interface{}) error {
+		arr, err := arrayField(rec, field)
+		if err != nil {
+			return err
+		}
+
+		rec[field] = append(arr, value)
+
+		return nil
+	})
+}
+
+// Pull atomically removes every element equal to a value from an array field
+// of a record. It takes a table name, the record id, the field name and the
+// value to remove. It returns any error encountered.
+func (db *DB) Pull(tblName string, fileId string, field string, v interface{}) error {
+	value, err := toJSONValue(v)
+	if err != nil {
+		return err
+	}
+
+	return db.mutate(tblName, fileId, func(rec map[string]interface{}) error {
+		arr, err := arrayField(rec, field)
+		if err != nil {
+			return err
+		}
+
+		kept := []interface{}{}
+		for _, x := range arr {
+			if !reflect.DeepEqual(x, value) {
+				kept = append(kept, x)
+			}
+		}
+
+		if len(kept) == len(arr) {
+			return errUnchanged
+		}
+
+		rec[field] = kept
+
+		return nil
+	})
+}
+
+// Unset atomically removes a field from a record.
+// It takes a table name, the record id and the field name. It returns any
+// error encountered.
+func (db *DB) Unset(tblName string, fileId string, field string) error {
+	return db.mutate(tblName, fileId, func(rec map[string]interface{}) error {
+		if _, ok := rec[field]; !ok {
+			return errUnchanged
+		}
+
+		delete(rec, field)
+
+		return nil
+	})
+}
+
+// SetIfAbsent atomically sets a field of a record, but only if the field is
+// missing or null. It takes a table name, the record id, the field name and the
+// value to set. It returns whether the value was set and any error
+// encountered.
+func (db *DB) SetIfAbsent(tblName string, fileId string, field string, v interface{}) (bool, error) {
+	var set bool
+
+	value, err := toJSONValue(v)
+	if err != nil {
+		return false, err
+	}
+
+	err = db.mutate(tblName, fileId, func(rec map[string]interface{}) error {
+		if current, ok := rec[field]; ok && current != nil {
+			return errUnchanged
+		}
+
+		rec[field] = value
+		set = true
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return set, nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// arrayField returns the array held by a field, or an empty array if the field
+// is missing or null.
+func arrayField(rec map[string]interface{}, field string) ([]interface{}, error) {
+	v, ok := rec[field]
+	if !ok || v == nil {
+		return []interface{}{}, nil
+	}
+
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, ErrFieldType
+	}
+
+	return arr, nil
+}
+
+// toJSONValue converts a Go value into the generic form it takes once decoded
+// from a record, so that it compares equal to values read back from disk.
+func toJSONValue(v interface{}) (interface{}, error) {
+	var value interface{}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &value)
+
+	return value, err
+}
@@ -0,0 +1,371 @@
+package ivy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidPatch is returned by Patch when the patch document is malformed
+	// or one of its operations cannot be applied.
+	ErrInvalidPatch = errors.New("ivy: invalid patch")
+
+	// ErrPatchTestFailed is returned by Patch when a JSON Patch "test"
+	// operation does not match the record.
+	ErrPatchTestFailed = errors.New("ivy: patch test failed")
+)
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// Patch applies a partial update to a record for the specified table.
+// It takes a table name, the record id and a patch document. A patch that is a
+// JSON object is applied as an RFC 7396 JSON Merge Patch; a patch that is a
+// JSON array is applied as an RFC 6902 JSON Patch. The whole patch is applied
+// under the table's write lock and either succeeds or leaves the record
+// unchanged. It returns ErrNotFound if there is no record with that id,
+// ErrPatchTestFailed if a "test" operation fails, or any error encountered.
+func (db *DB) Patch(tblName string, fileId string, patch []byte) error {
+	return db.mutate(tblName, fileId, func(rec map[string]interface{}) error {
+		return applyPatch(rec, patch)
+	})
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// applyPatch applies a merge patch or JSON patch to a decoded record.
+func applyPatch(rec map[string]interface{}, patch []byte) error {
+	var doc interface{}
+
+	trimmed := bytes.TrimSpace(patch)
+	if len(trimmed) == 0 {
+		return ErrInvalidPatch
+	}
+
+	switch trimmed[0] {
+	case '{':
+		var mergePatch map[string]interface{}
+
+		err := json.Unmarshal(trimmed, &mergePatch)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+
+		doc = applyMergePatch(rec, mergePatch)
+	case '[':
+		var ops []patchOp
+
+		err := json.Unmarshal(trimmed, &ops)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+
+		doc, err = applyJSONPatch(map[string]interface{}(rec), ops)
+		if err != nil {
+			return err
+		}
+	default:
+		return ErrInvalidPatch
+	}
+
+	newRec, ok := doc.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: patched record is not an object", ErrInvalidPatch)
+	}
+
+	// Swap the patched contents into the caller's map.
+	for k := range rec {
+		delete(rec, k)
+	}
+	for k, v := range newRec {
+		rec[k] = v
+	}
+
+	return nil
+}
+
+// applyMergePatch implements the MergePatch function of RFC 7396.
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	} else {
+		targetObj = copyValue(targetObj).(map[string]interface{})
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = applyMergePatch(targetObj[k], v)
+		}
+	}
+
+	return targetObj
+}
+
+// patchOp is a single RFC 6902 operation. Value is kept raw so that an explicit
+// null can be told apart from a missing value.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies RFC 6902 operations in order to a copy of doc.
+func applyJSONPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	doc = copyValue(doc)
+
+	for i, op := range ops {
+		var value interface{}
+		var err error
+
+		if op.Path == nil {
+			return nil, fmt.Errorf("%w: operation %d has no path", ErrInvalidPatch, i)
+		}
+
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("%w: operation %d has no value", ErrInvalidPatch, i)
+			}
+			err = json.Unmarshal(op.Value, &value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, fmt.Errorf("%w: operation %d has no from", ErrInvalidPatch, i)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("%w: operation %d has unknown op %q", ErrInvalidPatch, i, op.Op)
+		}
+
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, *op.Path, value)
+		case "remove":
+			doc, _, err = pointerRemove(doc, *op.Path)
+		case "replace":
+			doc, _, err = pointerRemove(doc, *op.Path)
+			if err == nil {
+				doc, err = pointerAdd(doc, *op.Path, value)
+			}
+		case "move":
+			if strings.HasPrefix(*op.Path, *op.From+"/") {
+				err = errors.New("cannot move a value into one of its children")
+				break
+			}
+			var moved interface{}
+			doc, moved, err = pointerRemove(doc, *op.From)
+			if err == nil {
+				doc, err = pointerAdd(doc, *op.Path, moved)
+			}
+		case "copy":
+			var copied interface{}
+			copied, err = pointerGet(doc, *op.From)
+			if err == nil {
+				doc, err = pointerAdd(doc, *op.Path, copyValue(copied))
+			}
+		case "test":
+			var actual interface{}
+			actual, err = pointerGet(doc, *op.Path)
+			if err == nil && !reflect.DeepEqual(actual, value) {
+				return nil, fmt.Errorf("%w: operation %d at %q", ErrPatchTestFailed, i, *op.Path)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+		}
+	}
+
+	return doc, nil
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("pointer %q does not start with '/'", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+// pointerGet returns the value a JSON pointer refers to.
+func pointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			v, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("path %q does not exist", pointer)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			doc = container[i]
+		default:
+			return nil, fmt.Errorf("path %q does not exist", pointer)
+		}
+	}
+
+	return doc, nil
+}
+
+// pointerAdd adds a value at a JSON pointer, returning the new document.
+func pointerAdd(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := pointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		container[last] = value
+		return doc, nil
+	case []interface{}:
+		i := len(container)
+		if last != "-" {
+			i, err = arrayIndex(last, len(container)+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		grown := append(container[:i:i], append([]interface{}{value}, container[i:]...)...)
+		return pointerSet(doc, parentPointer, grown)
+	default:
+		return nil, fmt.Errorf("path %q does not exist", parentPointer)
+	}
+}
+
+// pointerRemove removes the value at a JSON pointer, returning the new
+// document and the removed value.
+func pointerRemove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("cannot remove the whole record")
+	}
+
+	removed, err := pointerGet(doc, pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, _ := pointerGet(doc, parentPointer)
+	last := tokens[len(tokens)-1]
+
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		delete(container, last)
+		return doc, removed, nil
+	default:
+		arr := container.([]interface{})
+		i, _ := arrayIndex(last, len(arr))
+		shrunk := append(arr[:i:i], arr[i+1:]...)
+		doc, err = pointerSet(doc, parentPointer, shrunk)
+		return doc, removed, err
+	}
+}
+
+// pointerSet replaces the value at an existing JSON pointer.
+func pointerSet(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, _ := parsePointer(pointer)
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := pointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		container[last] = value
+	case []interface{}:
+		i, err := arrayIndex(last, len(container))
+		if err != nil {
+			return nil, err
+		}
+		container[i] = value
+	}
+
+	return doc, nil
+}
+
+// arrayIndex parses a JSON pointer token as an index into an array of length n.
+func arrayIndex(token string, n int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= n || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("array index %q is out of range", token)
+	}
+	return i, nil
+}
+
+// copyValue deep copies a decoded JSON value.
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, x := range t {
+			m[k] = copyValue(x)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, x := range t {
+			a[i] = copyValue(x)
+		}
+		return a
+	default:
+		return v
+	}
+}
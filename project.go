@@ -0,0 +1,355 @@
+package ivy
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Type Projection selects the fields of a record to load. Paths are field
+// names, with dots separating the names of nested fields, e.g. "engine.model";
+// a path that passes through an array applies to every object in it. When
+// Include is set only the listed fields are kept, and Exclude then removes
+// fields from what is left. Only the selected fields are decoded. A projection
+// that includes only top-level fields listed in fieldsToIndex, and excludes
+// nothing, is answered from the indexes without reading the record files
+// whenever the indexes hold the records' values.
+type Projection struct {
+	Include []string
+	Exclude []string
+}
+
+// Type ProjectedRecord is a record returned by FindAllProjected, holding only
+// the fields its projection selected.
+type ProjectedRecord struct {
+	Id     string
+	Record map[string]interface{}
+}
+
+// pathTree is a set of projection paths, split on dots into a tree.
+type pathTree struct {
+	leaf     bool
+	children map[string]*pathTree
+}
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// FindProjected loads up a struct with selected fields of a record.
+// It takes a table name, a pointer to a struct, the record id and the
+// projection. If the struct is a Record, its AfterFind method is run as it
+// would be by Find. It returns any error encountered.
+func (db *DB) FindProjected(tblName string, rec interface{}, fileId string, proj Projection) error {
+	if !validFileId(fileId) {
+		return ErrInvalidId
+	}
+
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	if db.isExpired(tblName, fileId) {
+		return db.notFoundErr(tblName, fileId)
+	}
+
+	doc, err := db.projectRec(tblName, fileId, proj)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, rec)
+	if err != nil {
+		return err
+	}
+
+	if r, ok := rec.(Record); ok {
+		r.AfterFind(db, fileId)
+	}
+
+	return nil
+}
+
+// FindAllProjected returns selected fields of many records in one call.
+// It takes a table name, the ids of the records, or nil for every record in
+// the table, and the projection. It returns the records in the order of ids,
+// skipping any that do not exist, and any error encountered.
+func (db *DB) FindAllProjected(tblName string, ids []string, proj Projection) ([]ProjectedRecord, error) {
+	var recs []ProjectedRecord
+
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	if ids == nil {
+		ids = db.fileIdsInDataDir(tblName)
+	}
+
+	for _, fileId := range db.liveIds(tblName, ids) {
+		if !validFileId(fileId) {
+			return nil, ErrInvalidId
+		}
+
+		doc, err := db.projectRec(tblName, fileId, proj)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		recs = append(recs, ProjectedRecord{Id: fileId, Record: doc})
+	}
+
+	return recs, nil
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// projectRec returns the selected fields of a record, from the covering
+// indexes if they can answer the projection, otherwise from the record file.
+// The caller must hold the table's read lock.
+func (db *DB) projectRec(tblName string, fileId string, proj Projection) (map[string]interface{}, error) {
+	if doc, ok := db.projectFromIndexes(tblName, fileId, proj); ok {
+		return doc, nil
+	}
+
+	data, err := db.readRecData(tblName, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	return proj.apply(data)
+}
+
+// projectFromIndexes answers a projection from the field indexes. It returns
+// false if the projection is not covered by the indexes or the indexes do not
+// hold one of the record's values, which happens when the value is missing or
+// not a string.
+func (db *DB) projectFromIndexes(tblName string, fileId string, proj Projection) (map[string]interface{}, bool) {
+	if len(proj.Include) == 0 || len(proj.Exclude) > 0 {
+		return nil, false
+	}
+
+	doc := make(map[string]interface{})
+
+	for _, fldName := range proj.Include {
+		values, ok := db.fldValues[tblName][fldName]
+		if !ok {
+			return nil, false
+		}
+
+		value, ok := values[fileId]
+		if !ok {
+			return nil, false
+		}
+
+		doc[fldName] = value
+	}
+
+	return doc, true
+}
+
+//*****************************************************************************
+// Private Projection Methods
+//*****************************************************************************
+
+// apply decodes the selected fields of a marshalled record.
+func (proj Projection) apply(data []byte) (map[string]interface{}, error) {
+	var v interface{}
+	var err error
+
+	exclude := newPathTree(proj.Exclude)
+
+	if len(proj.Include) > 0 {
+		v, _, err = includeRaw(data, newPathTree(proj.Include), exclude)
+	} else {
+		v, err = excludeRaw(data, exclude)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	doc, _ := v.(map[string]interface{})
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+
+	return doc, nil
+}
+
+//*****************************************************************************
+// Private pathTree Methods
+//*****************************************************************************
+
+// excludes answers whether a path tree selects the whole of a field.
+func (t *pathTree) excludes(name string) bool {
+	return t != nil && t.children[name] != nil && t.children[name].leaf
+}
+
+// child returns the subtree of a path tree for a field, or nil.
+func (t *pathTree) child(name string) *pathTree {
+	if t == nil {
+		return nil
+	}
+	return t.children[name]
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// newPathTree builds a path tree from dotted paths. It returns nil if there
+// are no paths.
+func newPathTree(paths []string) *pathTree {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	root := &pathTree{}
+
+	for _, p := range paths {
+		node := root
+		for _, name := range strings.Split(p, ".") {
+			if node.children == nil {
+				node.children = make(map[string]*pathTree)
+			}
+			if node.children[name] == nil {
+				node.children[name] = &pathTree{}
+			}
+			node = node.children[name]
+		}
+		node.leaf = true
+	}
+
+	return root
+}
+
+// includeRaw decodes the parts of a JSON value selected by an include tree,
+// leaving out the parts selected by an exclude tree, which may be nil. It
+// returns the value, whether anything was selected and any error encountered.
+func includeRaw(raw json.RawMessage, include *pathTree, exclude *pathTree) (interface{}, bool, error) {
+	if include.leaf {
+		v, err := excludeRaw(raw, exclude)
+		return v, true, err
+	}
+
+	switch firstByte(raw) {
+	case '{':
+		var fields map[string]json.RawMessage
+
+		err := json.Unmarshal(raw, &fields)
+		if err != nil {
+			return nil, false, err
+		}
+
+		doc := make(map[string]interface{})
+
+		for name, child := range include.children {
+			fieldRaw, ok := fields[name]
+			if !ok || exclude.excludes(name) {
+				continue
+			}
+
+			v, ok, err := includeRaw(fieldRaw, child, exclude.child(name))
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				doc[name] = v
+			}
+		}
+
+		return doc, true, nil
+	case '[':
+		var items []json.RawMessage
+
+		err := json.Unmarshal(raw, &items)
+		if err != nil {
+			return nil, false, err
+		}
+
+		arr := make([]interface{}, 0, len(items))
+
+		for _, item := range items {
+			v, ok, err := includeRaw(item, include, exclude)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				arr = append(arr, v)
+			}
+		}
+
+		return arr, true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+// excludeRaw decodes a JSON value, leaving out the parts selected by an
+// exclude tree, which may be nil.
+func excludeRaw(raw json.RawMessage, exclude *pathTree) (interface{}, error) {
+	var v interface{}
+
+	if exclude == nil || (firstByte(raw) != '{' && firstByte(raw) != '[') {
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	}
+
+	if firstByte(raw) == '[' {
+		var items []json.RawMessage
+
+		err := json.Unmarshal(raw, &items)
+		if err != nil {
+			return nil, err
+		}
+
+		arr := make([]interface{}, len(items))
+		for i, item := range items {
+			arr[i], err = excludeRaw(item, exclude)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return arr, nil
+	}
+
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := make(map[string]interface{}, len(fields))
+
+	for name, fieldRaw := range fields {
+		if exclude.excludes(name) {
+			continue
+		}
+
+		doc[name], err = excludeRaw(fieldRaw, exclude.child(name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+// firstByte returns the first non-space byte of a JSON value.
+func firstByte(raw []byte) byte {
+	raw = bytes.TrimLeft(raw, " \t\r\n")
+	if len(raw) == 0 {
+		return 0
+	}
+	return raw[0]
+}
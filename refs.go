@@ -0,0 +1,423 @@
+package ivy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Type OnDelete says what happens to the records that reference a record when
+// that record is deleted.
+type OnDelete int
+
+const (
+	Restrict OnDelete = iota // refuse to delete a record that is still referenced
+	Cascade                  // delete the referencing records as well
+	SetNull                  // clear the reference in the referencing records
+)
+
+// Type Reference declares that a field of a table holds the ids of records in
+// another table, like a foreign key. The field may hold a single id or an array
+// of ids; null or a missing field references nothing. Every write to the table
+// must reference records that exist, and OnDelete decides what happens to the
+// referencing records when a referenced record is deleted. References are not
+// enforced when records expire or are restored from the trash.
+type Reference struct {
+	Field    string
+	Table    string
+	OnDelete OnDelete
+}
+
+var (
+	// ErrDanglingReference is returned by writes that reference a record that
+	// does not exist.
+	ErrDanglingReference = errors.New("ivy: referenced record does not exist")
+
+	// ErrReferenced is returned by Delete when a record is still referenced
+	// through a Restrict reference.
+	ErrReferenced = errors.New("ivy: record is still referenced")
+)
+
+// recKey identifies a record across tables.
+type recKey struct {
+	tblName string
+	fileId  string
+}
+
+// referrer is a reference from another table, and the table it is in.
+type referrer struct {
+	tblName string
+	ref     Reference
+}
+
+// refUpdate is a reference to clear in a record that survives a delete.
+type refUpdate struct {
+	recKey
+	field string
+	refId string
+}
+
+// deletePlan holds every change a Delete makes once its cascades have been
+// followed: the records to remove, in order, the references to clear and the
+// Restrict references that must all come from removed records.
+type deletePlan struct {
+	rec    interface{} // the record loaded by DeleteRecord, or nil
+	doomed map[recKey]bool
+	order  []recKey
+	nulls  []refUpdate
+	blocks []refUpdate
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// referrers returns the references other tables make to a table, in table
+// order.
+func (db *DB) referrers(tblName string) []referrer {
+	var refs []referrer
+
+	for _, other := range db.configuredTbls() {
+		for _, ref := range db.options(other).References {
+			if ref.Table == tblName {
+				refs = append(refs, referrer{tblName: other, ref: ref})
+			}
+		}
+	}
+
+	return refs
+}
+
+// writeLocks locks a table for writing and the tables it references for
+// reading. It returns a function that releases the locks.
+func (db *DB) writeLocks(tblName string) func() {
+	var readTbls []string
+
+	for _, ref := range db.options(tblName).References {
+		readTbls = append(readTbls, ref.Table)
+	}
+
+	return db.lockTbls([]string{tblName}, readTbls)
+}
+
+// deleteLocks locks for writing a table and every table a delete from it can
+// reach: the tables referencing it and, in turn, the tables referencing those.
+// The tables that those tables reference are locked for reading, since records
+// whose references are cleared are checked against them. It returns a function
+// that releases the locks.
+func (db *DB) deleteLocks(tblName string) func() {
+	var readTbls []string
+
+	writeTbls := []string{tblName}
+	seen := map[string]bool{tblName: true}
+
+	for i := 0; i < len(writeTbls); i++ {
+		for _, r := range db.referrers(writeTbls[i]) {
+			if !seen[r.tblName] {
+				seen[r.tblName] = true
+				writeTbls = append(writeTbls, r.tblName)
+			}
+		}
+	}
+
+	for _, writeTbl := range writeTbls {
+		for _, ref := range db.options(writeTbl).References {
+			readTbls = append(readTbls, ref.Table)
+		}
+	}
+
+	return db.lockTbls(writeTbls, readTbls)
+}
+
+// lockTbls takes the write locks of some tables and the read locks of others.
+// Locks are always taken in table name order, so that writers spanning several
+// tables cannot deadlock. A table in both lists is locked for writing. It
+// returns a function that releases the locks.
+func (db *DB) lockTbls(writeTbls []string, readTbls []string) func() {
+	write := make(map[string]bool)
+	for _, tblName := range writeTbls {
+		write[tblName] = true
+	}
+
+	var tblNames []string
+	for _, tblName := range append(append([]string(nil), writeTbls...), readTbls...) {
+		if !stringInSlice(tblName, tblNames) {
+			tblNames = append(tblNames, tblName)
+		}
+	}
+	sort.Strings(tblNames)
+
+	for _, tblName := range tblNames {
+		if write[tblName] {
+			db.rwLocks[tblName].Lock()
+		} else {
+			db.rwLocks[tblName].RLock()
+		}
+	}
+
+	return func() {
+		for i := len(tblNames) - 1; i >= 0; i-- {
+			if write[tblNames[i]] {
+				db.rwLocks[tblNames[i]].Unlock()
+			} else {
+				db.rwLocks[tblNames[i]].RUnlock()
+			}
+		}
+	}
+}
+
+// checkRefs answers whether every record a decoded record references exists.
+// It returns ErrDanglingReference, wrapped with the first missing record, if
+// not. The caller must hold the referenced tables' locks.
+func (db *DB) checkRefs(tblName string, rec map[string]interface{}) error {
+	for _, ref := range db.options(tblName).References {
+		for _, refId := range refIds(rec[ref.Field]) {
+			if !validFileId(refId) || !db.recExists(ref.Table, refId) || db.isExpired(ref.Table, refId) {
+				return fmt.Errorf("%w: %s %q in field %s", ErrDanglingReference, ref.Table, refId, ref.Field)
+			}
+		}
+	}
+
+	return nil
+}
+
+// initRefIndexes rebuilds the reverse indexes of a table's references, which
+// map each referenced id to the ids of the records referencing it.
+func (db *DB) initRefIndexes(tblName string) error {
+	indexes := make(map[string]map[string][]string)
+
+	for _, ref := range db.options(tblName).References {
+		indexes[ref.Field] = make(map[string][]string)
+	}
+
+	for _, fileId := range db.fileIdsInDataDir(tblName) {
+		rec, err := db.loadRecMap(tblName, fileId)
+		if err != nil {
+			return err
+		}
+
+		for fldName, index := range indexes {
+			for _, refId := range refIds(rec[fldName]) {
+				if !stringInSlice(fileId, index[refId]) {
+					index[refId] = append(index[refId], fileId)
+				}
+			}
+		}
+	}
+
+	db.refIndexes[tblName] = indexes
+
+	return nil
+}
+
+// planDelete works out everything that deleting a record involves, following
+// Cascade references to the records that must go with it. It returns the plan,
+// or ErrReferenced, wrapped with the first blocking record, if a Restrict
+// reference comes from a record that would survive the delete. The caller must
+// hold the locks taken by deleteLocks.
+func (db *DB) planDelete(tblName string, fileId string) (*deletePlan, error) {
+	plan := &deletePlan{doomed: make(map[recKey]bool)}
+
+	db.planRecDelete(plan, recKey{tblName, fileId})
+
+	for _, block := range plan.blocks {
+		if !plan.doomed[block.recKey] {
+			return nil, fmt.Errorf("%w: %s %q refers to %q in field %s", ErrReferenced, block.tblName, block.fileId, block.refId, block.field)
+		}
+	}
+
+	return plan, nil
+}
+
+// planRecDelete adds a record to a delete plan, along with the records its
+// deletion cascades to.
+func (db *DB) planRecDelete(plan *deletePlan, key recKey) {
+	if plan.doomed[key] {
+		return
+	}
+	plan.doomed[key] = true
+	plan.order = append(plan.order, key)
+
+	for _, r := range db.referrers(key.tblName) {
+		for _, fileId := range db.liveIds(r.tblName, db.refIndexes[r.tblName][r.ref.Field][key.fileId]) {
+			update := refUpdate{recKey: recKey{r.tblName, fileId}, field: r.ref.Field, refId: key.fileId}
+
+			switch r.ref.OnDelete {
+			case Cascade:
+				db.planRecDelete(plan, update.recKey)
+			case SetNull:
+				plan.nulls = append(plan.nulls, update)
+			default:
+				plan.blocks = append(plan.blocks, update)
+			}
+		}
+	}
+}
+
+// applyDelete carries out a delete plan. Everything that can refuse the delete
+// is checked before anything is written: the before-delete hooks of every
+// doomed record, and the before-update hooks, schema and references of every
+// record whose references are cleared. It returns the records whose references
+// were cleared and any error encountered.
+func (db *DB) applyDelete(plan *deletePlan) (map[recKey]map[string]interface{}, error) {
+	var cleared []recKey
+
+	changed := make(map[recKey]bool)
+	oldRecs := make(map[recKey]map[string]interface{})
+	newRecs := make(map[recKey]map[string]interface{})
+	doomedRecs := make(map[recKey]map[string]interface{})
+	rebuildTbls := make(map[string]bool)
+
+	for i, key := range plan.order {
+		var rec interface{}
+		if i == 0 {
+			rec = plan.rec
+		}
+
+		err := db.beforeDelete(key.tblName, key.fileId, rec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Clear every reference a surviving record makes to the doomed records at
+	// once, so that it is never written pointing at a record that is gone.
+	for _, update := range plan.nulls {
+		if plan.doomed[update.recKey] {
+			continue
+		}
+
+		newRec, ok := newRecs[update.recKey]
+		if !ok {
+			var oldRec map[string]interface{}
+
+			data, err := db.readRecData(update.tblName, update.fileId)
+			if err != nil {
+				return nil, err
+			}
+
+			err = json.Unmarshal(data, &oldRec)
+			if err == nil {
+				err = json.Unmarshal(data, &newRec)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			oldRecs[update.recKey] = oldRec
+			newRecs[update.recKey] = newRec
+		}
+
+		if clearRef(newRec, update.field, update.refId) == nil && !changed[update.recKey] {
+			changed[update.recKey] = true
+			cleared = append(cleared, update.recKey)
+		}
+	}
+
+	for _, key := range cleared {
+		err := db.beforeWrite(key.tblName, key.fileId, newRecs[key], false)
+		if err == nil {
+			err = db.validateRec(key.tblName, newRecs[key])
+		}
+		if err == nil {
+			err = db.checkRefs(key.tblName, newRecs[key])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The doomed records are needed to take them out of the indexes. The
+	// indexes of a table with a record that cannot be read are rebuilt instead.
+	for _, key := range plan.order {
+		rec, err := db.loadRecMap(key.tblName, key.fileId)
+		if err != nil {
+			rebuildTbls[key.tblName] = true
+			continue
+		}
+		doomedRecs[key] = rec
+	}
+
+	for _, key := range plan.order {
+		err := db.removeRec(key.tblName, key.fileId)
+		if err != nil {
+			return nil, err
+		}
+
+		if rebuildTbls[key.tblName] {
+			continue
+		}
+
+		err = db.updateRecIndexes(key.tblName, key.fileId, doomedRecs[key], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if db.expiring(key.tblName) {
+			db.trackExpiry(key.tblName, key.fileId, nil)
+		}
+	}
+
+	updated := make(map[recKey]map[string]interface{})
+
+	for _, key := range cleared {
+		written, err := db.writeRec(key.tblName, key.fileId, newRecs[key], oldRecs[key])
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.updateRecIndexes(key.tblName, key.fileId, oldRecs[key], written)
+		if err != nil {
+			return nil, err
+		}
+
+		updated[key] = written
+	}
+
+	for tblName := range rebuildTbls {
+		err := db.initTblIndexes(tblName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return updated, nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// refIds returns the ids held in a reference field.
+func refIds(v interface{}) []string {
+	if s, ok := v.(string); ok {
+		return []string{s}
+	}
+	return stringsOf(v)
+}
+
+// clearRef removes a referenced id from a reference field, setting a single
+// id field to null.
+func clearRef(rec map[string]interface{}, fldName string, refId string) error {
+	switch v := rec[fldName].(type) {
+	case string:
+		if v == refId {
+			rec[fldName] = nil
+			return nil
+		}
+	case []interface{}:
+		kept := make([]interface{}, 0, len(v))
+		for _, x := range v {
+			if x != refId {
+				kept = append(kept, x)
+			}
+		}
+		if len(kept) != len(v) {
+			rec[fldName] = kept
+			return nil
+		}
+	}
+
+	return errUnchanged
+}
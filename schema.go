@@ -0,0 +1,394 @@
+package ivy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Type Schema describes the allowed shape of a record. It supports the subset
+// of JSON Schema that matters for flat-file records: type (including the
+// ["type", "null"] form), properties, required, additionalProperties, items,
+// enum, minimum, maximum, minLength, maxLength, pattern, minItems and maxItems.
+// A Schema can be parsed from a JSON Schema document with ParseSchema or built
+// directly in Go as a field spec, e.g.
+//
+//	&ivy.Schema{
+//		Type:     "object",
+//		Required: []string{"name"},
+//		Properties: map[string]*ivy.Schema{
+//			"name":  {Type: "string", MinLength: ivy.Int(1)},
+//			"speed": {Type: "integer", Minimum: ivy.Float(0)},
+//		},
+//	}
+type Schema struct {
+	Type                 string             `json:"-"`
+	Nullable             bool               `json:"-"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Type ValidationError describes one way in which a record breaks its table's
+// schema. Path is a JSON pointer to the offending value, e.g. "/tags/2".
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return "record: " + e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Type ValidationErrors lists every way in which a record breaks its table's
+// schema. It is the error returned by writes that fail validation.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, ve := range e {
+		msgs[i] = ve.Error()
+	}
+	return "ivy: record failed validation: " + strings.Join(msgs, "; ")
+}
+
+// ParseSchema parses a JSON Schema document into a Schema.
+// It returns the schema and any error encountered, including keywords whose
+// values are invalid.
+func ParseSchema(data []byte) (*Schema, error) {
+	schema := new(Schema)
+
+	err := json.Unmarshal(data, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	err = schema.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+// Float returns a pointer to a float64, for use in Go-defined schemas.
+func Float(f float64) *float64 { return &f }
+
+// Int returns a pointer to an int, for use in Go-defined schemas.
+func Int(i int) *int { return &i }
+
+// UnmarshalJSON decodes a JSON Schema document, accepting "type" as either a
+// string or an array of a type and "null".
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	type plain Schema
+
+	var raw struct {
+		plain
+		Type json.RawMessage `json:"type"`
+	}
+
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	*s = Schema(raw.plain)
+
+	if len(raw.Type) == 0 {
+		return nil
+	}
+
+	var types []string
+	if json.Unmarshal(raw.Type, &s.Type) == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw.Type, &types); err != nil {
+		return fmt.Errorf("ivy: schema type must be a string or an array: %v", err)
+	}
+
+	for _, t := range types {
+		switch {
+		case t == "null":
+			s.Nullable = true
+		case s.Type == "":
+			s.Type = t
+		default:
+			return fmt.Errorf("ivy: schema type %v is not supported", types)
+		}
+	}
+	if s.Type == "" {
+		s.Type = "null"
+	}
+
+	return nil
+}
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// ValidateTable audits every record of a table against the table's schema.
+// It takes a table name. It returns a map of the ids of invalid or unreadable
+// records to their errors, and any error encountered. Tables without a schema
+// only report unreadable records.
+func (db *DB) ValidateTable(tblName string) (map[string]error, error) {
+	problems := make(map[string]error)
+
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	for _, fileId := range db.fileIdsInDataDir(tblName) {
+		rec, err := db.loadRecMap(tblName, fileId)
+		if err != nil {
+			problems[fileId] = err
+			continue
+		}
+
+		err = db.validateRec(tblName, rec)
+		if err != nil {
+			problems[fileId] = err
+		}
+	}
+
+	return problems, nil
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// validateRec checks a decoded record against its table's schema, if it has
+// one. The fields Ivy maintains for the table are only checked when the schema
+// declares them, so that schemas forbidding additional properties need not.
+func (db *DB) validateRec(tblName string, rec map[string]interface{}) error {
+	schema := db.options(tblName).Schema
+	if schema == nil {
+		return nil
+	}
+
+	var managed []string
+	if db.options(tblName).Timestamps {
+		managed = append(managed, CreatedAtField, UpdatedAtField)
+	}
+	if db.expiring(tblName) {
+		managed = append(managed, ExpiresAtField)
+	}
+
+	doc := rec
+	for _, fldName := range managed {
+		if _, ok := schema.Properties[fldName]; ok {
+			continue
+		}
+		if _, ok := rec[fldName]; !ok {
+			continue
+		}
+
+		if len(doc) == len(rec) {
+			doc = make(map[string]interface{}, len(rec))
+			for k, v := range rec {
+				doc[k] = v
+			}
+		}
+		delete(doc, fldName)
+	}
+
+	if errs := schema.validate(doc, ""); len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+//*****************************************************************************
+// Private Schema Methods
+//*****************************************************************************
+
+// compile checks a schema and its subschemas and compiles their patterns.
+func (s *Schema) compile() error {
+	switch s.Type {
+	case "", "object", "array", "string", "number", "integer", "boolean", "null":
+	default:
+		return fmt.Errorf("ivy: unknown schema type %q", s.Type)
+	}
+
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("ivy: bad schema pattern %q: %v", s.Pattern, err)
+		}
+		s.re = re
+	}
+
+	for _, sub := range s.Properties {
+		if err := sub.compile(); err != nil {
+			return err
+		}
+	}
+
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+
+	return nil
+}
+
+// validate checks a decoded JSON value against the schema, returning every
+// violation found. path is the JSON pointer of the value.
+func (s *Schema) validate(v interface{}, path string) ValidationErrors {
+	var errs ValidationErrors
+
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if v == nil && (s.Nullable || s.Type == "" || s.Type == "null") {
+		return nil
+	}
+
+	if s.Type != "" && !hasType(v, s.Type) {
+		fail("expected %s, got %s", s.Type, typeName(v))
+		return errs
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(normalizeNumbers(e), v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := t[name]; !ok {
+				errs = append(errs, ValidationError{Path: path + "/" + escapePointer(name), Message: "required field is missing"})
+			}
+		}
+
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if sub, ok := s.Properties[k]; ok {
+				errs = append(errs, sub.validate(t[k], path+"/"+escapePointer(k))...)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, ValidationError{Path: path + "/" + escapePointer(k), Message: "field is not allowed"})
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(t) < *s.MinItems {
+			fail("expected at least %d items, got %d", *s.MinItems, len(t))
+		}
+		if s.MaxItems != nil && len(t) > *s.MaxItems {
+			fail("expected at most %d items, got %d", *s.MaxItems, len(t))
+		}
+		if s.Items != nil {
+			for i, item := range t {
+				errs = append(errs, s.Items.validate(item, fmt.Sprintf("%s/%d", path, i))...)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(t)
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("expected at least %d characters, got %d", *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("expected at most %d characters, got %d", *s.MaxLength, n)
+		}
+		if s.re != nil && !s.re.MatchString(t) {
+			fail("does not match pattern %q", s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && t < *s.Minimum {
+			fail("must be at least %v, got %v", *s.Minimum, t)
+		}
+		if s.Maximum != nil && t > *s.Maximum {
+			fail("must be at most %v, got %v", *s.Maximum, t)
+		}
+	}
+
+	return errs
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// hasType answers whether a decoded JSON value has a JSON Schema type.
+func hasType(v interface{}, schemaType string) bool {
+	switch schemaType {
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	default:
+		return typeName(v) == schemaType
+	}
+}
+
+// typeName returns the JSON Schema type name of a decoded JSON value.
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// normalizeNumbers converts the Go numeric types that can appear in a Go-defined
+// enum into float64, to compare equal with decoded JSON numbers.
+func normalizeNumbers(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	default:
+		return v
+	}
+}
+
+// escapePointer escapes a field name for use in a JSON pointer.
+func escapePointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
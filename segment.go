@@ -0,0 +1,588 @@
+package ivy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Type SegmentOptions selects the segment storage engine for a table, for
+// tables too large to keep one file per record. Records are appended to
+// segment files of up to MaxSegmentSize bytes in the table's _segments
+// directory, and found through an index of their offsets kept in memory and
+// rebuilt from the segments when the database is opened. Replaced and deleted
+// records leave dead entries behind; once more than CompactRatio of the
+// table's segment bytes are dead and there is more than one segment, the live
+// records are rewritten into fresh segments. Zero values select a 64 MiB
+// maximum and a ratio of one half; a negative ratio turns off automatic
+// compaction, leaving it to CompactTable.
+//
+// Soft deleted records, history and quarantined records are still kept one
+// file per record. Use ConvertStorage to move an existing table between the
+// two layouts.
+type SegmentOptions struct {
+	MaxSegmentSize int64
+	CompactRatio   float64
+}
+
+// segmentsDir is the name of the directory, inside a table directory, that
+// holds the segments of a table using segment storage.
+const segmentsDir = "_segments"
+
+const (
+	defaultMaxSegmentSize = 64 << 20
+	defaultCompactRatio   = 0.5
+)
+
+// The operations of segment entries.
+const (
+	segmentPut byte = iota + 1
+	segmentDelete
+)
+
+// segmentHeaderLen is the length of the header of a segment entry: the
+// lengths of the id and the data as big endian uint32s and the operation. The
+// id and data follow, then the CRC-32C of everything before it.
+const segmentHeaderLen = 9
+
+var (
+	errSegmentShort    = errors.New("ivy: segment entry is truncated")
+	errSegmentChecksum = errors.New("ivy: segment entry fails its checksum")
+)
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// ConvertStorage moves the records of a table stored in the other layout into
+// the layout the table is configured with: from one file per record into
+// segments if TableOptions.Segments is set, and back again if it is not. Set
+// or clear Segments, open the database and call ConvertStorage. It is safe to
+// call again after an interrupted conversion.
+// It takes a table name. It returns the number of records moved and any error
+// encountered.
+func (db *DB) ConvertStorage(tblName string) (int, error) {
+	var from, to recStore
+
+	converted := 0
+
+	db.rwLocks[tblName].Lock()
+	defer db.rwLocks[tblName].Unlock()
+
+	files := fileStore{dir: db.tblPath(tblName), ext: db.codec(tblName).Ext()}
+	segDir := path.Join(db.tblPath(tblName), segmentsDir)
+
+	if seg, ok := db.segments[tblName]; ok {
+		from, to = files, seg
+	} else {
+		if _, err := os.Stat(segDir); os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		seg, err := openSegmentStore(segDir, nil)
+		if err != nil {
+			return 0, err
+		}
+		from, to = seg, files
+	}
+
+	for _, fileId := range from.ids() {
+		// A record in both layouts was already moved by an earlier, interrupted
+		// conversion and may have been updated since.
+		if !to.exists(fileId) {
+			stored, err := from.read(fileId)
+			if err != nil {
+				return converted, err
+			}
+
+			err = to.write(fileId, stored)
+			if err != nil {
+				return converted, err
+			}
+			converted++
+		}
+
+		if _, ok := from.(fileStore); ok {
+			err := from.remove(fileId)
+			if err != nil {
+				return converted, err
+			}
+		}
+	}
+
+	if _, ok := to.(fileStore); ok {
+		err := os.RemoveAll(segDir)
+		if err != nil {
+			return converted, err
+		}
+	}
+
+	return converted, db.initTblIndexes(tblName)
+}
+
+// CompactTable rewrites the live records of a table using segment storage
+// into fresh segments, dropping dead entries. It takes a table name. It
+// returns any error encountered.
+func (db *DB) CompactTable(tblName string) error {
+	db.rwLocks[tblName].Lock()
+	defer db.rwLocks[tblName].Unlock()
+
+	seg, ok := db.segments[tblName]
+	if !ok {
+		return fmt.Errorf("ivy: table %s does not use segment storage", tblName)
+	}
+
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+
+	return seg.compact()
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// openSegments opens the segment stores of the tables configured to use them.
+func (db *DB) openSegments() error {
+	for _, tblName := range db.configuredTbls() {
+		opts := db.options(tblName).Segments
+		if opts == nil {
+			continue
+		}
+
+		seg, err := openSegmentStore(path.Join(db.tblPath(tblName), segmentsDir), opts)
+		if err != nil {
+			return err
+		}
+		db.segments[tblName] = seg
+	}
+
+	return nil
+}
+
+//=============================================================================
+// Segment Store
+//=============================================================================
+
+// segmentStore keeps records as entries appended to numbered segment files.
+// Its recStore methods may be called concurrently, as the bulk loader does,
+// and take mu; the helpers they share expect it to be held.
+type segmentStore struct {
+	mu     sync.Mutex
+	dir    string
+	opts   SegmentOptions
+	index  map[string]segmentLoc
+	segs   []int // segment numbers, oldest first
+	active int   // the segment appended to
+	size   int64 // length of the active segment
+	total  int64 // length of all segments
+	dead   int64 // length of dead entries
+}
+
+// segmentLoc locates the live entry of a record.
+type segmentLoc struct {
+	seg    int
+	off    int64 // offset of the entry
+	length int64 // length of the entry
+}
+
+// openSegmentStore opens the segments in a directory, which need not exist
+// yet, and indexes their entries. A torn entry at the end of the newest
+// segment, left by a crash, is cut off. A complete entry failing its checksum
+// stays in place as a corrupt record, while any entry whose length runs past
+// its segment otherwise is reported as ErrCorrupt.
+func openSegmentStore(dir string, opts *SegmentOptions) (*segmentStore, error) {
+	s := &segmentStore{dir: dir, index: make(map[string]segmentLoc)}
+
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.MaxSegmentSize == 0 {
+		s.opts.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	if s.opts.CompactRatio == 0 {
+		s.opts.CompactRatio = defaultCompactRatio
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		if n, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".seg")); err == nil && !file.IsDir() {
+			s.segs = append(s.segs, n)
+		}
+	}
+	sort.Ints(s.segs)
+
+	for i, n := range s.segs {
+		err := s.load(n, i == len(s.segs)-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.segs) > 0 {
+		s.active = s.segs[len(s.segs)-1]
+	}
+
+	return s, nil
+}
+
+func (s *segmentStore) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.liveIds()
+}
+
+func (s *segmentStore) read(fileId string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readData(fileId)
+}
+
+func (s *segmentStore) write(fileId string, stored []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.append(fileId, segmentPut, stored)
+	if err != nil {
+		return err
+	}
+	return s.maybeCompact()
+}
+
+func (s *segmentStore) remove(fileId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.appendDelete(fileId)
+}
+
+func (s *segmentStore) exists(fileId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.index[fileId]
+	return ok
+}
+
+// moveOut does not check the entry's checksum, so that corrupt records can be
+// quarantined.
+func (s *segmentStore) moveOut(fileId string, filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loc, ok := s.index[fileId]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: path.Join(s.dir, fileId), Err: os.ErrNotExist}
+	}
+
+	entry, err := s.readEntry(loc)
+	if err != nil {
+		return err
+	}
+
+	idLen := int64(binary.BigEndian.Uint32(entry[0:4]))
+	dataLen := int64(binary.BigEndian.Uint32(entry[4:8]))
+
+	err = ioutil.WriteFile(filename, entry[segmentHeaderLen+idLen:segmentHeaderLen+idLen+dataLen], 0600)
+	if err != nil {
+		return err
+	}
+
+	return s.appendDelete(fileId)
+}
+
+func (s *segmentStore) moveIn(fileId string, filename string) error {
+	stored, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	err = s.write(fileId, stored)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(filename)
+}
+
+// liveIds returns the ids of the live records, sorted.
+func (s *segmentStore) liveIds() []string {
+	ids := make([]string, 0, len(s.index))
+	for fileId := range s.index {
+		ids = append(ids, fileId)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// readData reads and checks the data of a record.
+func (s *segmentStore) readData(fileId string) ([]byte, error) {
+	loc, ok := s.index[fileId]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path.Join(s.dir, fileId), Err: os.ErrNotExist}
+	}
+
+	entry, err := s.readEntry(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, data, _, err := parseSegmentEntry(entry)
+	if err != nil {
+		return nil, fmt.Errorf("%w: segment %d at offset %d: %v", ErrCorrupt, loc.seg, loc.off, err)
+	}
+
+	return data, nil
+}
+
+// appendDelete appends a deletion entry for a live record.
+func (s *segmentStore) appendDelete(fileId string) error {
+	if _, ok := s.index[fileId]; !ok {
+		return &os.PathError{Op: "remove", Path: path.Join(s.dir, fileId), Err: os.ErrNotExist}
+	}
+
+	err := s.append(fileId, segmentDelete, nil)
+	if err != nil {
+		return err
+	}
+	return s.maybeCompact()
+}
+
+// load indexes the entries of a segment.
+func (s *segmentStore) load(n int, newest bool) error {
+	filename := s.segPath(n)
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	off := 0
+	damaged := false
+	for off < len(data) {
+		fileId, op, _, entryLen, err := parseSegmentEntry(data[off:])
+
+		// Only an entry running past the end of the newest segment is a torn
+		// write. After a damaged entry, whose lengths cannot be trusted, it is
+		// not.
+		if newest && !damaged && err == errSegmentShort {
+			err = os.Truncate(filename, int64(off))
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if err == errSegmentShort {
+			return fmt.Errorf("%w: segment %s at offset %d: %v", ErrCorrupt, filename, off, err)
+		}
+
+		// A complete entry that is damaged is indexed as the live entry of the
+		// record it names, so that reading the record reports ErrCorrupt and
+		// it can be quarantined like a corrupt record file.
+		if err != nil {
+			fileId, op = damagedEntryId(data[off:off+entryLen], n, off), segmentPut
+			damaged = true
+		}
+
+		s.apply(fileId, op, segmentLoc{seg: n, off: int64(off), length: int64(entryLen)})
+		off += entryLen
+	}
+
+	s.total += int64(off)
+	if newest {
+		s.size = int64(off)
+	}
+
+	return nil
+}
+
+// append encodes an entry and appends it.
+func (s *segmentStore) append(fileId string, op byte, data []byte) error {
+	entry := make([]byte, segmentHeaderLen, segmentHeaderLen+len(fileId)+len(data)+4)
+	binary.BigEndian.PutUint32(entry[0:4], uint32(len(fileId)))
+	binary.BigEndian.PutUint32(entry[4:8], uint32(len(data)))
+	entry[8] = op
+	entry = append(entry, fileId...)
+	entry = append(entry, data...)
+	entry = append(entry, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(entry[len(entry)-4:], crc32.Checksum(entry[:len(entry)-4], crc32c))
+
+	return s.appendEntry(fileId, op, entry)
+}
+
+// appendEntry appends an encoded entry to the active segment, starting a new
+// segment when the active one is full, and indexes it.
+func (s *segmentStore) appendEntry(fileId string, op byte, entry []byte) error {
+	if len(s.segs) == 0 || (s.size > 0 && s.size+int64(len(entry)) > s.opts.MaxSegmentSize) {
+		s.active++
+		s.segs = append(s.segs, s.active)
+		s.size = 0
+	}
+
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.segPath(s.active), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(entry)
+	if err != nil {
+		// Cut off whatever part of the entry was written, so the next entry
+		// does not follow a torn one.
+		f.Truncate(s.size)
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	s.apply(fileId, op, segmentLoc{seg: s.active, off: s.size, length: int64(len(entry))})
+	s.size += int64(len(entry))
+	s.total += int64(len(entry))
+
+	return nil
+}
+
+// apply indexes an entry, counting the entry it replaces, or the entry itself
+// for deletions, as dead.
+func (s *segmentStore) apply(fileId string, op byte, loc segmentLoc) {
+	if old, ok := s.index[fileId]; ok {
+		s.dead += old.length
+		delete(s.index, fileId)
+	}
+
+	if op == segmentPut {
+		s.index[fileId] = loc
+	} else {
+		s.dead += loc.length
+	}
+}
+
+// maybeCompact compacts the store once enough of it is dead.
+func (s *segmentStore) maybeCompact() error {
+	if s.opts.CompactRatio < 0 || len(s.segs) < 2 || float64(s.dead) <= s.opts.CompactRatio*float64(s.total) {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact copies the live entries into new segments and removes the old
+// ones. Until the old segments are removed, the new ones, being newer, win
+// when the store is reopened. Damaged entries are copied as they are, to be
+// quarantined or repaired later.
+func (s *segmentStore) compact() error {
+	next := &segmentStore{dir: s.dir, opts: s.opts, index: make(map[string]segmentLoc), active: s.active}
+
+	for _, fileId := range s.liveIds() {
+		entry, err := s.readEntry(s.index[fileId])
+		if err == nil {
+			err = next.appendEntry(fileId, segmentPut, entry)
+		}
+		if err != nil {
+			for _, n := range next.segs {
+				os.Remove(next.segPath(n))
+			}
+			return err
+		}
+	}
+
+	for _, n := range s.segs {
+		err := os.Remove(s.segPath(n))
+		if err != nil {
+			return err
+		}
+	}
+
+	s.index, s.segs, s.active = next.index, next.segs, next.active
+	s.size, s.total, s.dead = next.size, next.total, next.dead
+
+	return nil
+}
+
+// readEntry reads the entry at a location.
+func (s *segmentStore) readEntry(loc segmentLoc) ([]byte, error) {
+	f, err := os.Open(s.segPath(loc.seg))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entry := make([]byte, loc.length)
+
+	_, err = f.ReadAt(entry, loc.off)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// segPath returns the file name of a segment.
+func (s *segmentStore) segPath(n int) string {
+	return path.Join(s.dir, fmt.Sprintf("%06d.seg", n))
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// damagedEntryId returns the id a damaged segment entry names, or one made up
+// from its position if that is not a valid record id.
+func damagedEntryId(entry []byte, seg int, off int) string {
+	idLen := int(binary.BigEndian.Uint32(entry[0:4]))
+
+	fileId := string(entry[segmentHeaderLen : segmentHeaderLen+idLen])
+	if !validFileId(fileId) || !utf8.ValidString(fileId) {
+		fileId = fmt.Sprintf("damaged-%d-%d", seg, off)
+	}
+
+	return fileId
+}
+
+// parseSegmentEntry parses the segment entry at the start of data. It returns
+// the record id, the operation, the record data, the length of the entry and
+// any error encountered. The length is set whenever the header could be read.
+func parseSegmentEntry(data []byte) (string, byte, []byte, int, error) {
+	if len(data) < segmentHeaderLen {
+		return "", 0, nil, 0, errSegmentShort
+	}
+
+	idLen := int(binary.BigEndian.Uint32(data[0:4]))
+	dataLen := int(binary.BigEndian.Uint32(data[4:8]))
+	op := data[8]
+
+	entryLen := segmentHeaderLen + idLen + dataLen + 4
+	if idLen < 0 || dataLen < 0 || entryLen < 0 || len(data) < entryLen {
+		return "", 0, nil, 0, errSegmentShort
+	}
+
+	body := data[:entryLen-4]
+	if crc32.Checksum(body, crc32c) != binary.BigEndian.Uint32(data[entryLen-4:]) {
+		return "", 0, nil, entryLen, errSegmentChecksum
+	}
+
+	if op != segmentPut && op != segmentDelete {
+		return "", 0, nil, entryLen, fmt.Errorf("ivy: unknown segment operation %d", op)
+	}
+
+	return string(body[segmentHeaderLen : segmentHeaderLen+idLen]), op, body[segmentHeaderLen+idLen:], entryLen, nil
+}
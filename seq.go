@@ -0,0 +1,38 @@
+//go:build go1.23
+
+package ivy
+
+import "iter"
+
+// Seq adapts a cursor to a Go 1.23 iterator over record ids and records
+// decoded as T, for use with range:
+//
+//	cur, err := db.Scan("planes", nil)
+//	...
+//	for id, plane := range ivy.Seq[Plane](cur) {
+//		...
+//	}
+//	err = cur.Err()
+//
+// If *T is a Record its AfterFind method is run for each record. The cursor is
+// closed when the loop ends, including when it is stopped early. A record that
+// fails to decode ends the loop, and Err reports the error.
+func Seq[T any](c *Cursor) iter.Seq2[string, T] {
+	return func(yield func(string, T) bool) {
+		defer c.Close()
+
+		for c.Next() {
+			var rec T
+
+			err := c.Decode(&rec)
+			if err != nil {
+				c.err = err
+				return
+			}
+
+			if !yield(c.Id(), rec) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package ivy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// recStore holds the stored form of a table's records, keyed by record id.
+// Tables keep one file per record unless they are configured with
+// TableOptions.Segments. The caller must hold the table's lock: a read lock
+// for ids, read and exists and the write lock for the rest.
+type recStore interface {
+	// ids returns the ids of all records in the store.
+	ids() []string
+
+	// read returns the stored bytes of a record, or an error satisfying
+	// os.IsNotExist if there is no such record.
+	read(fileId string) ([]byte, error)
+
+	// write stores the bytes of a record, replacing any previous ones.
+	write(fileId string, stored []byte) error
+
+	// remove removes a record, or returns an error satisfying os.IsNotExist if
+	// there is no such record.
+	remove(fileId string) error
+
+	// exists answers whether there is a record with an id.
+	exists(fileId string) bool
+
+	// moveOut moves a record out of the store into a file of its own.
+	moveOut(fileId string, filename string) error
+
+	// moveIn moves a record held in a file of its own into the store.
+	moveIn(fileId string, filename string) error
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// store returns the record store of a table.
+func (db *DB) store(tblName string) recStore {
+	if seg, ok := db.segments[tblName]; ok {
+		return seg
+	}
+	return fileStore{dir: db.tblPath(tblName), ext: db.codec(tblName).Ext()}
+}
+
+// trashStore returns the store holding the soft deleted records of a table,
+// which always keeps one file per record.
+func (db *DB) trashStore(tblName string) recStore {
+	return fileStore{dir: db.trashPath(tblName), ext: db.codec(tblName).Ext()}
+}
+
+//=============================================================================
+// File Store
+//=============================================================================
+
+// fileStore keeps each record in a file of its own, named <id><ext>, in a
+// directory.
+type fileStore struct {
+	dir string
+	ext string
+}
+
+func (s fileStore) ids() []string {
+	return fileIdsInDir(s.dir, s.ext)
+}
+
+func (s fileStore) read(fileId string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(fileId))
+}
+
+func (s fileStore) write(fileId string, stored []byte) error {
+	return ioutil.WriteFile(s.path(fileId), stored, 0600)
+}
+
+func (s fileStore) remove(fileId string) error {
+	return os.Remove(s.path(fileId))
+}
+
+func (s fileStore) exists(fileId string) bool {
+	_, err := os.Stat(s.path(fileId))
+	return err == nil
+}
+
+func (s fileStore) moveOut(fileId string, filename string) error {
+	return os.Rename(s.path(fileId), filename)
+}
+
+// moveIn also marks the record as modified now, since the file may carry an
+// older time, so incremental backups pick it up.
+func (s fileStore) moveIn(fileId string, filename string) error {
+	err := os.Rename(filename, s.path(fileId))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	return os.Chtimes(s.path(fileId), now, now)
+}
+
+// path returns the file name of a record.
+func (s fileStore) path(fileId string) string {
+	return path.Join(s.dir, fileId+s.ext)
+}
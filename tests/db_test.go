@@ -1,11 +1,16 @@
 package ivy
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/JayTeeSF/ivy"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 var db *ivy.DB
@@ -144,6 +149,2057 @@ func TestCreateWithId(t *testing.T) {
 
 }
 
+func TestFindFuzzyIdsForField(t *testing.T) {
+	foo := Foo{Bar: "Mustang", Tags: []string{"test"}}
+	id, err := db.Create("foos", foo)
+	if err != nil {
+		t.Error("Create failed:", err)
+	}
+
+	matches, err := db.FindFuzzyIdsForField("foos", "bar", "Mustnag", 1)
+	if err != nil {
+		t.Error("FindFuzzyIdsForField failed:", err)
+	}
+
+	if len(matches) != 1 || matches[0].Value != "Mustang" {
+		t.Fatal("Expected a single match for 'Mustang', got ", matches)
+	}
+
+	if matches[0].Distance != 1 {
+		t.Error("Expected distance 1, got ", matches[0].Distance)
+	}
+
+	if matches[0].Ids[0] != id {
+		t.Error("Expected id", id, "got ", matches[0].Ids[0])
+	}
+
+	err = db.Delete("foos", id)
+	if err != nil {
+		t.Error("Delete failed:", err)
+	}
+}
+
+func TestFindNearestIds(t *testing.T) {
+	vecIndexes := []ivy.VectorIndex{{Field: "embedding", Metric: ivy.Euclidean, Approximate: true}}
+	tdb := openTempDB(t, "docs", &ivy.TableOptions{VectorIndexes: vecIndexes})
+	defer tdb.Close()
+
+	for i := 0; i < 100; i++ {
+		doc := Doc{Name: fmt.Sprint("doc", i), Embedding: []float64{float64(i), float64(i % 7)}}
+		if _, err := tdb.Create("docs", doc); err != nil {
+			t.Fatal("Create failed:", err)
+		}
+	}
+
+	// Ids start at 1, so doc42 is record 43.
+	for _, metric := range []ivy.Metric{ivy.Euclidean, ivy.Cosine} {
+		matches, err := tdb.FindNearestIds("docs", "embedding", []float64{42, 0.1}, 3, metric)
+		if err != nil {
+			t.Fatal("FindNearestIds failed:", err)
+		}
+
+		if len(matches) != 3 {
+			t.Fatal("Expected 3 matches, got ", matches)
+		}
+
+		if metric == ivy.Euclidean && matches[0].Id != "43" {
+			t.Error("Expected nearest id to be '43', got ", matches[0].Id)
+		}
+	}
+}
+
+func TestFindNearestIdsAfterUpdates(t *testing.T) {
+	vecIndexes := []ivy.VectorIndex{{Field: "embedding", Metric: ivy.Euclidean, Approximate: true}}
+	tdb := openTempDB(t, "docs", &ivy.TableOptions{VectorIndexes: vecIndexes})
+	defer tdb.Close()
+
+	// Ids start at 1, so doc i is record i+1.
+	for i := 0; i < 100; i++ {
+		tdb.Create("docs", Doc{Name: fmt.Sprint("doc", i), Embedding: []float64{float64(i), 0}})
+	}
+	for i := 0; i < 50; i++ {
+		tdb.Update("docs", Doc{Name: fmt.Sprint("doc", i), Embedding: []float64{float64(i + 1000), 0}}, fmt.Sprint(i+1))
+	}
+	for i := 50; i < 60; i++ {
+		tdb.Delete("docs", fmt.Sprint(i+1))
+	}
+
+	queries := []struct {
+		query   []float64
+		nearest string
+	}{
+		{[]float64{1005, 0.1}, "6"},
+		{[]float64{55, 0}, "61"},
+		{[]float64{3, 0}, "61"},
+	}
+
+	for _, q := range queries {
+		matches, err := tdb.FindNearestIds("docs", "embedding", q.query, 3, ivy.Euclidean)
+		if err != nil || len(matches) != 3 || matches[0].Id != q.nearest {
+			t.Error("Expected ", q.nearest, " nearest to ", q.query, ", got ", matches, err)
+		}
+	}
+}
+
+func TestFindNearestIdsMixedDimensions(t *testing.T) {
+	vecIndexes := []ivy.VectorIndex{{Field: "embedding", Metric: ivy.Euclidean, Approximate: true}}
+	tdb := openTempDB(t, "docs", &ivy.TableOptions{VectorIndexes: vecIndexes})
+	defer tdb.Close()
+
+	embeddings := [][]float64{{1, 1}, {2, 2}, {3, 3, 3}, {4, 4}, {5}}
+	for i, embedding := range embeddings {
+		doc := Doc{Name: fmt.Sprint("doc", i), Embedding: embedding}
+		if _, err := tdb.Create("docs", doc); err != nil {
+			t.Fatal("Create failed:", err)
+		}
+	}
+
+	matches, err := tdb.FindNearestIds("docs", "embedding", []float64{4, 4.1}, 2, ivy.Euclidean)
+	if err != nil {
+		t.Fatal("FindNearestIds failed:", err)
+	}
+
+	if len(matches) != 2 || matches[0].Id != "4" {
+		t.Error("Expected two matches starting with '4', got ", matches)
+	}
+
+	matches, err = tdb.FindNearestIds("docs", "embedding", []float64{3, 3, 2}, 2, ivy.Euclidean)
+	if err != nil {
+		t.Fatal("FindNearestIds failed:", err)
+	}
+
+	if len(matches) != 1 || matches[0].Id != "3" {
+		t.Error("Expected the one three dimensional vector to match, got ", matches)
+	}
+}
+
+func TestGeoQueries(t *testing.T) {
+	geoIndexes := []ivy.GeoIndex{{Name: "location", LatField: "lat", LonField: "lon"}}
+	tdb := openTempDB(t, "airfields", &ivy.TableOptions{GeoIndexes: geoIndexes})
+	defer tdb.Close()
+
+	airfields := []Airfield{
+		{Name: "Duxford", Lat: 52.0908, Lon: 0.1319},
+		{Name: "Biggin Hill", Lat: 51.3308, Lon: 0.0325},
+		{Name: "Oshkosh", Lat: 43.9844, Lon: -88.5570},
+	}
+	for _, airfield := range airfields {
+		if _, err := tdb.Create("airfields", airfield); err != nil {
+			t.Fatal("Create failed:", err)
+		}
+	}
+
+	// From central London, Biggin Hill (id 2) is ~24km and Duxford (id 1) ~76km.
+	matches, err := tdb.FindIdsWithinRadius("airfields", "location", 51.5074, -0.1278, 100000)
+	if err != nil {
+		t.Fatal("FindIdsWithinRadius failed:", err)
+	}
+
+	if len(matches) != 2 || matches[0].Id != "2" || matches[1].Id != "1" {
+		t.Error("Expected ids '2' and '1', got ", matches)
+	}
+
+	matches, err = tdb.FindIdsWithinBox("airfields", "location", 40, -90, 45, -80)
+	if err != nil {
+		t.Fatal("FindIdsWithinBox failed:", err)
+	}
+
+	if len(matches) != 1 || matches[0].Id != "3" {
+		t.Error("Expected id '3', got ", matches)
+	}
+
+	matches, err = tdb.FindNearestGeoIds("airfields", "location", 40.7128, -74.0060, 1)
+	if err != nil {
+		t.Fatal("FindNearestGeoIds failed:", err)
+	}
+
+	if len(matches) != 1 || matches[0].Id != "3" {
+		t.Error("Expected id '3', got ", matches)
+	}
+}
+
+func TestGeoBoxOutOfRange(t *testing.T) {
+	geoIndexes := []ivy.GeoIndex{{Name: "location", LatField: "lat", LonField: "lon"}}
+	tdb := openTempDB(t, "airfields", &ivy.TableOptions{GeoIndexes: geoIndexes})
+	defer tdb.Close()
+
+	tdb.Create("airfields", Airfield{Name: "Somewhere", Lat: 10, Lon: 10})
+
+	// Bounds beyond the poles and the antimeridian are clamped to them.
+	matches, err := tdb.FindIdsWithinBox("airfields", "location", -100, -200, 100, 200)
+	if err != nil || len(matches) != 1 || matches[0].Id != "1" {
+		t.Error("Expected an oversized box to find id '1', got ", matches, err)
+	}
+
+	matches, _ = tdb.FindIdsWithinBox("airfields", "location", -100, 0, 5, 20)
+	if len(matches) != 0 {
+		t.Error("Expected no matches south of the point, got ", matches)
+	}
+}
+
+func TestCreateMany(t *testing.T) {
+	tdb := openTempDB(t, "foos", nil)
+	defer tdb.Close()
+
+	var recs []interface{}
+	for i := 0; i < 50; i++ {
+		recs = append(recs, Foo{Bar: fmt.Sprint("bulk", i), Tags: []string{"bulk"}})
+	}
+
+	ids, err := tdb.CreateMany("foos", recs)
+	if err != nil {
+		t.Fatal("CreateMany failed:", err)
+	}
+
+	if len(ids) != 50 || ids[0] != "1" || ids[49] != "50" {
+		t.Fatal("Expected ids '1' to '50', got ", ids)
+	}
+
+	foo := Foo{}
+
+	err = tdb.Find("foos", &foo, ids[49])
+	if err != nil {
+		t.Error("Find failed:", err)
+	}
+
+	if foo.Bar != "bulk49" {
+		t.Error("Expected 'bulk49', got ", foo.Bar)
+	}
+}
+
+func TestIndexesFollowWrites(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.Mkdir(dir+"/airfields", 0700)
+	if err != nil {
+		t.Fatal("Failed to create table dir:", err)
+	}
+
+	geoIndexes := []ivy.GeoIndex{{Name: "location", LatField: "lat", LonField: "lon"}}
+	tdb, err := ivy.OpenDBWithOptions(dir, map[string][]string{"airfields": {"name"}}, map[string]*ivy.TableOptions{
+		"airfields": {GeoIndexes: geoIndexes},
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	id, _ := tdb.Create("airfields", Airfield{Name: "Oshkosh", Lat: 43.9844, Lon: -88.5570})
+
+	err = tdb.Update("airfields", Airfield{Name: "Biggin Hill", Lat: 51.3308, Lon: 0.0325}, id)
+	if err != nil {
+		t.Fatal("Update failed:", err)
+	}
+
+	ids, _ := tdb.FindAllIdsForField("airfields", "name", "Oshkosh")
+	if len(ids) != 0 {
+		t.Error("Expected the old name to be gone from the index, got ", ids)
+	}
+
+	matches, _ := tdb.FindFuzzyIdsForField("airfields", "name", "Bigin Hill", 1)
+	if len(matches) != 1 || matches[0].Ids[0] != id {
+		t.Error("Expected the new name to be in the fuzzy index, got ", matches)
+	}
+
+	geoMatches, _ := tdb.FindIdsWithinRadius("airfields", "location", 51.5074, -0.1278, 100000)
+	if len(geoMatches) != 1 || geoMatches[0].Id != id {
+		t.Error("Expected the moved airfield near London, got ", geoMatches)
+	}
+
+	geoMatches, _ = tdb.FindIdsWithinBox("airfields", "location", 40, -90, 45, -80)
+	if len(geoMatches) != 0 {
+		t.Error("Expected nothing left at the old location, got ", geoMatches)
+	}
+}
+
+func TestInsertReplaceUpsert(t *testing.T) {
+	foo := Foo{Bar: "test", Tags: []string{"test"}}
+
+	err := db.Replace("foos", "2020", foo)
+	if err != ivy.ErrNotFound {
+		t.Error("Expected ErrNotFound, got ", err)
+	}
+
+	err = db.Insert("foos", "2020", foo)
+	if err != nil {
+		t.Error("Insert failed:", err)
+	}
+
+	err = db.Insert("foos", "2020", foo)
+	if err != ivy.ErrExists {
+		t.Error("Expected ErrExists, got ", err)
+	}
+
+	foo.Bar = "replaced"
+
+	err = db.Replace("foos", "2020", foo)
+	if err != nil {
+		t.Error("Replace failed:", err)
+	}
+
+	inserted, err := db.Upsert("foos", "2020", foo)
+	if err != nil || inserted {
+		t.Error("Expected Upsert to update, got ", inserted, err)
+	}
+
+	inserted, err = db.Upsert("foos", "2021", foo)
+	if err != nil || !inserted {
+		t.Error("Expected Upsert to insert, got ", inserted, err)
+	}
+
+	for _, id := range []string{"2020", "2021"} {
+		err = db.Delete("foos", id)
+		if err != nil {
+			t.Error("Delete failed:", err)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	foo := Foo{Bar: "test", Tags: []string{"test"}}
+	id, err := db.Create("foos", foo)
+	if err != nil {
+		t.Error("Create failed:", err)
+	}
+
+	err = db.Patch("foos", id, []byte(`{"bar": "merged"}`))
+	if err != nil {
+		t.Error("Patch failed:", err)
+	}
+
+	ids, err := db.FindAllIdsForField("foos", "bar", "merged")
+	if err != nil || len(ids) != 1 || ids[0] != id {
+		t.Error("Expected index to hold id", id, "for 'merged', got ", ids, err)
+	}
+
+	err = db.Patch("foos", id, []byte(`[
+		{"op": "test", "path": "/bar", "value": "merged"},
+		{"op": "add", "path": "/tags/-", "value": "patched"},
+		{"op": "replace", "path": "/bar", "value": "json-patched"}
+	]`))
+	if err != nil {
+		t.Error("Patch failed:", err)
+	}
+
+	err = db.Patch("foos", id, []byte(`[{"op": "test", "path": "/bar", "value": "merged"}]`))
+	if !errors.Is(err, ivy.ErrPatchTestFailed) {
+		t.Error("Expected ErrPatchTestFailed, got ", err)
+	}
+
+	foo = Foo{}
+
+	err = db.Find("foos", &foo, id)
+	if err != nil {
+		t.Error("Find failed:", err)
+	}
+
+	if foo.Bar != "json-patched" {
+		t.Error("Expected 'json-patched', got ", foo.Bar)
+	}
+
+	if len(foo.Tags) != 2 || foo.Tags[1] != "patched" {
+		t.Error("Expected second tag to be 'patched', got ", foo.Tags)
+	}
+
+	err = db.Delete("foos", id)
+	if err != nil {
+		t.Error("Delete failed:", err)
+	}
+}
+
+func TestPatchStampsIndexedTimestamps(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.Mkdir(dir+"/foos", 0700)
+	if err != nil {
+		t.Fatal("Failed to create table dir:", err)
+	}
+
+	tdb, err := ivy.OpenDBWithOptions(dir, map[string][]string{"foos": {"updated_at"}}, map[string]*ivy.TableOptions{
+		"foos": {Timestamps: true},
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	id, _ := tdb.Create("foos", StampedFoo{Bar: "test"})
+
+	time.Sleep(2 * time.Millisecond)
+
+	err = tdb.Patch("foos", id, []byte(`{"bar": "patched"}`))
+	if err != nil {
+		t.Fatal("Patch failed:", err)
+	}
+
+	foo := StampedFoo{}
+	tdb.Find("foos", &foo, id)
+
+	ids, _ := tdb.FindAllIdsForField("foos", "updated_at", foo.UpdatedAt.UTC().Format(time.RFC3339Nano))
+	if len(ids) != 1 || ids[0] != id {
+		t.Error("Expected the index to hold the new updated_at, got ", ids)
+	}
+}
+
+func TestFieldOperators(t *testing.T) {
+	foo := Foo{Bar: "test", Tags: []string{"test"}}
+	id, err := db.Create("foos", foo)
+	if err != nil {
+		t.Error("Create failed:", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = db.Inc("foos", id, "views", 1)
+		if err != nil {
+			t.Error("Inc failed:", err)
+		}
+	}
+
+	views, err := db.Inc("foos", id, "views", 0)
+	if err != nil || views != 3 {
+		t.Error("Expected 3 views, got ", views, err)
+	}
+
+	err = db.Push("foos", id, "tags", "pushed")
+	if err != nil {
+		t.Error("Push failed:", err)
+	}
+
+	err = db.Pull("foos", id, "tags", "test")
+	if err != nil {
+		t.Error("Pull failed:", err)
+	}
+
+	ids, err := db.FindAllIdsForTags("foos", []string{"pushed"})
+	if err != nil || len(ids) != 1 || ids[0] != id {
+		t.Error("Expected tag index to hold id", id, "got ", ids, err)
+	}
+
+	set, err := db.SetIfAbsent("foos", id, "bar", "ignored")
+	if err != nil || set {
+		t.Error("Expected SetIfAbsent to leave bar alone, got ", set, err)
+	}
+
+	err = db.Unset("foos", id, "views")
+	if err != nil {
+		t.Error("Unset failed:", err)
+	}
+
+	foo = Foo{}
+
+	err = db.Find("foos", &foo, id)
+	if err != nil {
+		t.Error("Find failed:", err)
+	}
+
+	if foo.Bar != "test" || len(foo.Tags) != 1 || foo.Tags[0] != "pushed" {
+		t.Error("Expected bar 'test' and tags ['pushed'], got ", foo)
+	}
+
+	err = db.Delete("foos", id)
+	if err != nil {
+		t.Error("Delete failed:", err)
+	}
+}
+
+func TestFieldOperatorsFailedWrite(t *testing.T) {
+	schema := &ivy.Schema{Type: "object", Properties: map[string]*ivy.Schema{
+		"views": {Type: "number", Maximum: ivy.Float(1)},
+		"bar":   {Type: "string", MaxLength: ivy.Int(4)},
+	}}
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{Schema: schema})
+	defer tdb.Close()
+
+	id, _ := tdb.Create("foos", map[string]interface{}{"views": 1})
+
+	views, err := tdb.Inc("foos", id, "views", 1)
+	if err == nil || views != 0 {
+		t.Error("Expected Inc past the maximum to fail with no value, got ", views, err)
+	}
+
+	set, err := tdb.SetIfAbsent("foos", id, "bar", "too long")
+	if err == nil || set {
+		t.Error("Expected SetIfAbsent of an invalid value to fail unset, got ", set, err)
+	}
+}
+
+func TestIdGenerators(t *testing.T) {
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{IdGenerator: ivy.NewSequenceGenerator()})
+	defer tdb.Close()
+
+	foo := Foo{Bar: "test", Tags: []string{"test"}}
+
+	_, err := tdb.CreateWithId("foos", "not-a-number", foo)
+	if err != nil {
+		t.Error("CreateWithId failed:", err)
+	}
+
+	id1, err := tdb.Create("foos", foo)
+	if err != nil {
+		t.Error("Create failed:", err)
+	}
+
+	err = tdb.Delete("foos", id1)
+	if err != nil {
+		t.Error("Delete failed:", err)
+	}
+
+	id2, err := tdb.Create("foos", foo)
+	if err != nil {
+		t.Error("Create failed:", err)
+	}
+
+	if id1 != "1" || id2 != "2" {
+		t.Error("Expected ids '1' and '2', got ", id1, id2)
+	}
+
+	gens := map[string]ivy.IdGenerator{
+		"uuidv4": ivy.NewUUIDv4Generator(),
+		"uuidv7": ivy.NewUUIDv7Generator(),
+		"ulid":   ivy.NewULIDGenerator(),
+		"ksuid":  ivy.NewKSUIDGenerator(),
+	}
+	lengths := map[string]int{"uuidv4": 36, "uuidv7": 36, "ulid": 26, "ksuid": 27}
+
+	for name, gen := range gens {
+		first, err := gen.NextId("")
+		if err != nil {
+			t.Error(name, "failed:", err)
+		}
+
+		second, _ := gen.NextId("")
+		if first == second || len(first) != lengths[name] {
+			t.Error(name, "generated bad ids:", first, second)
+		}
+	}
+}
+
+func TestSequenceWithSegments(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	open := func(gen ivy.IdGenerator) *ivy.DB {
+		tdb, err := ivy.OpenDBWithOptions(dir, nil, map[string]*ivy.TableOptions{
+			"foos": {Segments: &ivy.SegmentOptions{}, IdGenerator: gen},
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+		return tdb
+	}
+
+	tdb := open(nil)
+	for _, bar := range []string{"one", "two", "three"} {
+		tdb.Create("foos", Foo{Bar: bar})
+	}
+	tdb.Close()
+
+	// The sequence starts after the records kept in segments.
+	tdb = open(ivy.NewSequenceGenerator())
+
+	id, err := tdb.Create("foos", Foo{Bar: "four"})
+	if err != nil || id != "4" {
+		t.Error("Expected id '4', got ", id, err)
+	}
+	tdb.Close()
+
+	// A generated id that is already taken is not overwritten.
+	tdb = open(fixedIdGenerator("1"))
+	defer tdb.Close()
+
+	_, err = tdb.Create("foos", Foo{Bar: "clash"})
+	if err != ivy.ErrExists {
+		t.Error("Expected ErrExists for a taken id, got ", err)
+	}
+
+	foo := Foo{}
+
+	err = tdb.Find("foos", &foo, "1")
+	if err != nil || foo.Bar != "one" {
+		t.Error("Expected the existing record to be kept, got ", foo, err)
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	schema, err := ivy.ParseSchema([]byte(`{
+		"type": "object",
+		"required": ["bar"],
+		"properties": {
+			"bar": {"type": "string", "minLength": 2},
+			"tags": {"type": ["array", "null"], "items": {"type": "string"}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal("ParseSchema failed:", err)
+	}
+
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{Schema: schema})
+	defer tdb.Close()
+
+	_, err = tdb.Create("foos", Foo{Bar: "ok", Tags: []string{"test"}})
+	if err != nil {
+		t.Error("Create failed:", err)
+	}
+
+	_, err = tdb.Create("foos", map[string]interface{}{"bar": "x", "tags": []interface{}{"a", 1}})
+
+	errs, ok := err.(ivy.ValidationErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatal("Expected 2 validation errors, got ", err)
+	}
+
+	if errs[0].Path != "/bar" || errs[1].Path != "/tags/1" {
+		t.Error("Expected errors at '/bar' and '/tags/1', got ", errs)
+	}
+
+	problems, err := tdb.ValidateTable("foos")
+	if err != nil || len(problems) != 0 {
+		t.Error("Expected no problems, got ", problems, err)
+	}
+}
+
+func TestSchemaWithTimestamps(t *testing.T) {
+	schema, err := ivy.ParseSchema([]byte(`{
+		"type": "object",
+		"additionalProperties": false,
+		"properties": {"bar": {"type": "string"}}
+	}`))
+	if err != nil {
+		t.Fatal("ParseSchema failed:", err)
+	}
+
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{Schema: schema, Timestamps: true})
+	defer tdb.Close()
+
+	id, err := tdb.Create("foos", map[string]interface{}{"bar": "test"})
+	if err != nil {
+		t.Fatal("Create failed:", err)
+	}
+
+	err = tdb.Patch("foos", id, []byte(`{"bar": "patched"}`))
+	if err != nil {
+		t.Error("Patch failed:", err)
+	}
+
+	problems, err := tdb.ValidateTable("foos")
+	if err != nil || len(problems) != 0 {
+		t.Error("Expected no problems, got ", problems, err)
+	}
+
+	_, err = tdb.Create("foos", map[string]interface{}{"bar": "test", "baz": 1})
+	if _, ok := err.(ivy.ValidationErrors); !ok {
+		t.Error("Expected other fields to still be refused, got ", err)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var created []string
+
+	hooks := &ivy.Hooks{
+		AfterCreate: func(db *ivy.DB, tblName string, fileId string, rec interface{}) {
+			created = append(created, fileId)
+		},
+		BeforeDelete: func(db *ivy.DB, tblName string, fileId string) error {
+			return errors.New("deletes are not allowed")
+		},
+	}
+
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{Hooks: hooks})
+	defer tdb.Close()
+
+	_, err := tdb.Create("foos", &HookedFoo{})
+	if err == nil || err.Error() != "bar is required" {
+		t.Error("Expected Validate to fail, got ", err)
+	}
+
+	id, err := tdb.Create("foos", &HookedFoo{Bar: "test"})
+	if err != nil {
+		t.Error("Create failed:", err)
+	}
+
+	foo := Foo{}
+
+	err = tdb.Find("foos", &foo, id)
+	if err != nil {
+		t.Error("Find failed:", err)
+	}
+
+	if len(foo.Tags) != 1 || foo.Tags[0] != "created" {
+		t.Error("Expected BeforeCreate to add tag 'created', got ", foo.Tags)
+	}
+
+	if len(created) != 1 || created[0] != id {
+		t.Error("Expected AfterCreate to run for id", id, "got ", created)
+	}
+
+	err = tdb.Delete("foos", id)
+	if err == nil {
+		t.Error("Expected BeforeDelete to abort the delete")
+	}
+}
+
+func TestDeleteHooks(t *testing.T) {
+	tdb := openTempDB(t, "foos", nil)
+	defer tdb.Close()
+
+	keep, _ := tdb.Create("foos", Foo{Bar: "keep"})
+	drop, _ := tdb.Create("foos", Foo{Bar: "drop"})
+
+	foo := DeletableFoo{}
+
+	err := tdb.DeleteRecord("foos", &foo, keep)
+	if err == nil || foo.Bar != "keep" {
+		t.Error("Expected BeforeDelete to see the record and abort the delete, got ", foo, err)
+	}
+
+	ids, _ := tdb.FindAllIds("foos")
+	if len(ids) != 2 {
+		t.Error("Expected both records to remain, got ", ids)
+	}
+
+	foo = DeletableFoo{}
+
+	err = tdb.DeleteRecord("foos", &foo, drop)
+	if err != nil || foo.DeletedId != drop {
+		t.Error("Expected AfterDelete to run for ", drop, ", got ", foo, err)
+	}
+
+	err = tdb.DeleteRecord("foos", &DeletableFoo{}, drop)
+	if !os.IsNotExist(err) {
+		t.Error("Expected a missing record error, got ", err)
+	}
+}
+
+func TestTimestampsAndSoftDelete(t *testing.T) {
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{Timestamps: true, SoftDelete: true})
+	defer tdb.Close()
+
+	id, err := tdb.Create("foos", Foo{Bar: "test", Tags: []string{"test"}})
+	if err != nil {
+		t.Error("Create failed:", err)
+	}
+
+	err = tdb.Update("foos", Foo{Bar: "test2", Tags: []string{"test"}}, id)
+	if err != nil {
+		t.Error("Update failed:", err)
+	}
+
+	foo := StampedFoo{}
+
+	err = tdb.Find("foos", &foo, id)
+	if err != nil {
+		t.Error("Find failed:", err)
+	}
+
+	if foo.CreatedAt.IsZero() || foo.UpdatedAt.Before(foo.CreatedAt) {
+		t.Error("Expected created_at and updated_at to be set, got ", foo.CreatedAt, foo.UpdatedAt)
+	}
+
+	err = tdb.Delete("foos", id)
+	if err != nil {
+		t.Error("Delete failed:", err)
+	}
+
+	ids, _ := tdb.FindAllIds("foos")
+	if len(ids) != 0 {
+		t.Error("Expected no live records, got ", ids)
+	}
+
+	err = tdb.Restore("foos", id)
+	if err != nil {
+		t.Error("Restore failed:", err)
+	}
+
+	err = tdb.Find("foos", &foo, id)
+	if err != nil || foo.Bar != "test2" {
+		t.Error("Expected restored record with bar 'test2', got ", foo.Bar, err)
+	}
+
+	err = tdb.Delete("foos", id)
+	if err != nil {
+		t.Error("Delete failed:", err)
+	}
+
+	purged, err := tdb.PurgeDeleted("foos", 0)
+	if err != nil || purged != 1 {
+		t.Error("Expected 1 record purged, got ", purged, err)
+	}
+}
+
+func TestSoftDeleteKeepsTrashedIds(t *testing.T) {
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{SoftDelete: true})
+	defer tdb.Close()
+
+	first, _ := tdb.Create("foos", Foo{Bar: "first"})
+
+	err := tdb.Delete("foos", first)
+	if err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+
+	second, _ := tdb.Create("foos", Foo{Bar: "second"})
+	if second == first {
+		t.Fatal("Expected a new id, got the trashed id ", second)
+	}
+
+	err = tdb.Delete("foos", second)
+	if err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+
+	err = tdb.Restore("foos", first)
+	if err != nil {
+		t.Fatal("Restore failed:", err)
+	}
+
+	foo := Foo{}
+
+	err = tdb.Find("foos", &foo, first)
+	if err != nil || foo.Bar != "first" {
+		t.Error("Expected the first record back, got ", foo.Bar, err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{History: true, HistoryLimit: 3})
+	defer tdb.Close()
+
+	id, err := tdb.Create("foos", Foo{Bar: "rev1"})
+	if err != nil {
+		t.Error("Create failed:", err)
+	}
+
+	afterFirst := time.Now()
+
+	for _, bar := range []string{"rev2", "rev3", "rev4"} {
+		err = tdb.Update("foos", Foo{Bar: bar}, id)
+		if err != nil {
+			t.Error("Update failed:", err)
+		}
+	}
+
+	revs, err := tdb.History("foos", id)
+	if err != nil {
+		t.Error("History failed:", err)
+	}
+
+	if len(revs) != 3 || revs[0].Rev != 2 || revs[2].Rev != 4 {
+		t.Fatal("Expected revisions 2 to 4, got ", revs)
+	}
+
+	foo := Foo{}
+
+	err = tdb.FindAtRevision("foos", &foo, id, 3)
+	if err != nil || foo.Bar != "rev3" {
+		t.Error("Expected 'rev3', got ", foo.Bar, err)
+	}
+
+	// Revision 1 has been pruned, so nothing is known as of just after it.
+	err = tdb.FindAsOf("foos", &foo, id, afterFirst)
+	if err != ivy.ErrNotFound {
+		t.Error("Expected ErrNotFound, got ", err)
+	}
+
+	err = tdb.Delete("foos", id)
+	if err != nil {
+		t.Error("Delete failed:", err)
+	}
+
+	err = tdb.FindAsOf("foos", &foo, id, time.Now())
+	if err != ivy.ErrNotFound {
+		t.Error("Expected ErrNotFound after delete, got ", err)
+	}
+
+	err = tdb.FindAsOf("foos", &foo, id, revs[2].Time)
+	if err != nil || foo.Bar != "rev4" {
+		t.Error("Expected 'rev4', got ", foo.Bar, err)
+	}
+}
+
+func TestHistoryWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	tdb, err := ivy.OpenDBWithOptions(dir, map[string][]string{"foos": {"bar"}}, map[string]*ivy.TableOptions{
+		"foos": {History: true},
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	id, _ := tdb.Create("foos", Foo{Bar: "before"})
+
+	// Put a file where the record's history belongs, so that it cannot be
+	// written to, even by root.
+	historyDir := dir + "/foos/_history/" + id
+	os.RemoveAll(historyDir)
+	ioutil.WriteFile(historyDir, nil, 0600)
+
+	err = tdb.Update("foos", Foo{Bar: "after"}, id)
+	if err == nil {
+		t.Fatal("Expected Update to fail without history")
+	}
+
+	foo := Foo{}
+
+	err = tdb.Find("foos", &foo, id)
+	if err != nil || foo.Bar != "before" {
+		t.Error("Expected the record to be left as it was, got ", foo, err)
+	}
+
+	ids, _ := tdb.FindAllIdsForField("foos", "bar", "before")
+	if len(ids) != 1 || ids[0] != id {
+		t.Error("Expected the index to match the record, got ", ids)
+	}
+
+	err = tdb.Delete("foos", id)
+	if err == nil {
+		t.Error("Expected Delete to fail without history")
+	}
+
+	err = tdb.Find("foos", &foo, id)
+	if err != nil {
+		t.Error("Expected the record to survive the failed delete, got ", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{Expiring: true})
+	defer tdb.Close()
+
+	keep, _ := tdb.Create("foos", Foo{Bar: "keep", Tags: []string{"test"}})
+	gone, _ := tdb.Create("foos", Foo{Bar: "gone", Tags: []string{"test"}})
+
+	err := tdb.Expire("foos", gone, 10*time.Millisecond)
+	if err != nil {
+		t.Error("Expire failed:", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	foo := Foo{}
+
+	err = tdb.Find("foos", &foo, gone)
+	if !os.IsNotExist(err) {
+		t.Error("Expected expired record to be missing, got ", err)
+	}
+
+	ids, _ := tdb.FindAllIds("foos")
+	if len(ids) != 1 || ids[0] != keep {
+		t.Error("Expected only the live record, got ", ids)
+	}
+
+	n, err := tdb.ReapExpired("foos")
+	if err != nil || n != 1 {
+		t.Error("Expected one record reaped, got ", n, err)
+	}
+
+	ids, _ = tdb.FindAllIds("foos")
+	if len(ids) != 1 {
+		t.Error("Expected one record left on disk, got ", ids)
+	}
+}
+
+func TestExpiredRecordsAreAbsent(t *testing.T) {
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{Expiring: true})
+	defer tdb.Close()
+
+	expire := func(id string) {
+		err := tdb.Expire("foos", id, time.Millisecond)
+		if err != nil {
+			t.Fatal("Expire failed:", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	id, _ := tdb.Create("foos", Foo{Bar: "old"})
+	expire(id)
+
+	if err := tdb.Replace("foos", id, Foo{Bar: "new"}); err != ivy.ErrNotFound {
+		t.Error("Expected Replace to fail with ErrNotFound, got ", err)
+	}
+	if err := tdb.Patch("foos", id, []byte(`{"bar": "new"}`)); err != ivy.ErrNotFound {
+		t.Error("Expected Patch to fail with ErrNotFound, got ", err)
+	}
+	if _, err := tdb.Inc("foos", id, "views", 1); err != ivy.ErrNotFound {
+		t.Error("Expected Inc to fail with ErrNotFound, got ", err)
+	}
+	if err := tdb.Push("foos", id, "tags", "new"); err != ivy.ErrNotFound {
+		t.Error("Expected Push to fail with ErrNotFound, got ", err)
+	}
+
+	err := tdb.Insert("foos", id, Foo{Bar: "new"})
+	if err != nil {
+		t.Fatal("Expected Insert over an expired record to succeed, got ", err)
+	}
+
+	foo := Foo{}
+
+	err = tdb.Find("foos", &foo, id)
+	if err != nil || foo.Bar != "new" {
+		t.Error("Expected the inserted record to be live, got ", foo.Bar, err)
+	}
+
+	expire(id)
+
+	inserted, err := tdb.Upsert("foos", id, Foo{Bar: "newer"})
+	if err != nil || !inserted {
+		t.Error("Expected Upsert over an expired record to insert, got ", inserted, err)
+	}
+}
+
+func TestReapErrors(t *testing.T) {
+	dir := t.TempDir()
+	reapErrs := make(chan error, 1)
+
+	err := os.Mkdir(dir+"/foos", 0700)
+	if err != nil {
+		t.Fatal("Failed to create table dir:", err)
+	}
+
+	tdb, err := ivy.OpenDBWithOptions(dir, nil, map[string]*ivy.TableOptions{
+		"foos": {
+			Expiring:     true,
+			History:      true,
+			ReapInterval: 5 * time.Millisecond,
+			OnReapError: func(tblName string, err error) {
+				select {
+				case reapErrs <- err:
+				default:
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	id, _ := tdb.Create("foos", Foo{Bar: "test"})
+
+	err = tdb.Expire("foos", id, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal("Expire failed:", err)
+	}
+
+	// Put a file where the record's history belongs, so that the reaper cannot
+	// record the deletion.
+	historyDir := dir + "/foos/_history/" + id
+	os.RemoveAll(historyDir)
+	ioutil.WriteFile(historyDir, nil, 0600)
+
+	select {
+	case err := <-reapErrs:
+		if err == nil {
+			t.Error("Expected a reap error, got nil")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the reaper to report an error")
+	}
+}
+
+func TestReapPartialFailure(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	tdb, err := ivy.OpenDBWithOptions(dir, map[string][]string{"foos": {"bar"}}, map[string]*ivy.TableOptions{
+		"foos": {Expiring: true, History: true, ReapInterval: time.Hour},
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	one, _ := tdb.Create("foos", Foo{Bar: "one"})
+	two, _ := tdb.Create("foos", Foo{Bar: "two"})
+	tdb.Expire("foos", one, time.Millisecond)
+	tdb.Expire("foos", two, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	// Block the history of the second record only.
+	historyDir := dir + "/foos/_history/" + two
+	os.RemoveAll(historyDir)
+	ioutil.WriteFile(historyDir, nil, 0600)
+
+	n, err := tdb.ReapExpired("foos")
+	if err == nil || n != 1 {
+		t.Error("Expected one record to be reaped before an error, got ", n, err)
+	}
+
+	ids, _ := tdb.FindAllIdsForField("foos", "bar", "one")
+	if len(ids) != 0 {
+		t.Error("Expected the reaped record to be out of the index, got ", ids)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, tblName := range []string{"planes", "flights", "crews", "repairs"} {
+		if err := os.Mkdir(dir+"/"+tblName, 0700); err != nil {
+			t.Fatal("Failed to create table dir:", err)
+		}
+	}
+
+	tdb, err := ivy.OpenDBWithOptions(dir, nil, map[string]*ivy.TableOptions{
+		"flights": {References: []ivy.Reference{{Field: "plane_id", Table: "planes", OnDelete: ivy.Cascade}}},
+		"crews":   {References: []ivy.Reference{{Field: "plane_ids", Table: "planes", OnDelete: ivy.SetNull}}},
+		"repairs": {References: []ivy.Reference{{Field: "plane_id", Table: "planes", OnDelete: ivy.Restrict}}},
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	plane1, _ := tdb.Create("planes", map[string]interface{}{"name": "Spitfire"})
+	plane2, _ := tdb.Create("planes", map[string]interface{}{"name": "Hurricane"})
+
+	_, err = tdb.Create("flights", map[string]interface{}{"plane_id": "99"})
+	if !errors.Is(err, ivy.ErrDanglingReference) {
+		t.Error("Expected ErrDanglingReference, got ", err)
+	}
+
+	flight, _ := tdb.Create("flights", map[string]interface{}{"plane_id": plane1})
+	crew, _ := tdb.Create("crews", map[string]interface{}{"plane_ids": []string{plane1, plane2}})
+	repair, _ := tdb.Create("repairs", map[string]interface{}{"plane_id": plane1})
+
+	err = tdb.Delete("planes", plane1)
+	if !errors.Is(err, ivy.ErrReferenced) {
+		t.Error("Expected ErrReferenced, got ", err)
+	}
+
+	err = tdb.Delete("repairs", repair)
+	if err != nil {
+		t.Error("Delete failed:", err)
+	}
+
+	err = tdb.Delete("planes", plane1)
+	if err != nil {
+		t.Error("Delete failed:", err)
+	}
+
+	var rec map[string]interface{}
+
+	err = tdb.Find("flights", &Doc{}, flight)
+	if !os.IsNotExist(err) {
+		t.Error("Expected flight to be deleted by cascade, got ", err)
+	}
+
+	data, _ := ioutil.ReadFile(dir + "/crews/" + crew + ".json")
+	json.Unmarshal(data, &rec)
+	if ids := fmt.Sprint(rec["plane_ids"]); ids != fmt.Sprint([]interface{}{plane2}) {
+		t.Error("Expected the deleted plane to be cleared from the crew, got ", ids)
+	}
+}
+
+func TestDeleteIsAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, tblName := range []string{"planes", "flights", "crews"} {
+		if err := os.Mkdir(dir+"/"+tblName, 0700); err != nil {
+			t.Fatal("Failed to create table dir:", err)
+		}
+	}
+
+	// Crews must always have a plane, so clearing one fails validation.
+	schema := &ivy.Schema{Type: "object", Properties: map[string]*ivy.Schema{"plane_id": {Type: "string"}}}
+
+	tdb, err := ivy.OpenDBWithOptions(dir, nil, map[string]*ivy.TableOptions{
+		"flights": {References: []ivy.Reference{{Field: "plane_id", Table: "planes", OnDelete: ivy.Cascade}}},
+		"crews":   {Schema: schema, References: []ivy.Reference{{Field: "plane_id", Table: "planes", OnDelete: ivy.SetNull}}},
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	plane, _ := tdb.Create("planes", map[string]interface{}{"name": "Spitfire"})
+	flight, _ := tdb.Create("flights", map[string]interface{}{"plane_id": plane})
+	tdb.Create("crews", map[string]interface{}{"plane_id": plane})
+
+	err = tdb.Delete("planes", plane)
+	if _, ok := err.(ivy.ValidationErrors); !ok {
+		t.Fatal("Expected the delete to fail validation, got ", err)
+	}
+
+	if err := tdb.Find("planes", &Doc{}, plane); err != nil {
+		t.Error("Expected the plane to survive, got ", err)
+	}
+	if err := tdb.Find("flights", &Doc{}, flight); err != nil {
+		t.Error("Expected the flight to survive, got ", err)
+	}
+
+	ids, _ := tdb.FindAllIds("flights")
+	if len(ids) != 1 {
+		t.Error("Expected the flight to still be listed, got ", ids)
+	}
+}
+
+func TestJoins(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, tblName := range []string{"planes", "flights"} {
+		if err := os.Mkdir(dir+"/"+tblName, 0700); err != nil {
+			t.Fatal("Failed to create table dir:", err)
+		}
+	}
+
+	tdb, err := ivy.OpenDBWithOptions(dir, map[string][]string{"planes": {"name"}}, map[string]*ivy.TableOptions{
+		"flights": {References: []ivy.Reference{{Field: "plane_id", Table: "planes"}}},
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	spitfire, _ := tdb.Create("planes", Plane{Name: "Spitfire"})
+	hurricane, _ := tdb.Create("planes", Plane{Name: "Hurricane"})
+	tdb.Create("flights", Flight{Code: "RAF1", PlaneId: spitfire})
+	tdb.Create("flights", Flight{Code: "RAF2", PlaneId: spitfire})
+
+	recs, err := tdb.FindJoined("planes", nil, ivy.Join{Table: "flights", On: "plane_id"})
+	if err != nil {
+		t.Error("FindJoined failed:", err)
+	}
+	if len(recs) != 1 || recs[0].Id != spitfire || len(recs[0].Related["flights"]) != 2 {
+		t.Error("Expected only the Spitfire with two flights, got ", recs)
+	}
+
+	recs, _ = tdb.FindJoined("planes", []string{spitfire, hurricane}, ivy.Join{Table: "flights", On: "plane_id", Kind: ivy.LeftJoin})
+	if len(recs) != 2 || len(recs[1].Related["flights"]) != 0 {
+		t.Error("Expected both planes from a left join, got ", recs)
+	}
+
+	_, err = tdb.FindJoined("planes", nil, ivy.Join{Table: "flights", On: "code"})
+	if err != ivy.ErrFieldNotIndexed {
+		t.Error("Expected ErrFieldNotIndexed, got ", err)
+	}
+
+	plane := Plane{}
+
+	err = tdb.FindWithRelated("planes", &plane, spitfire, ivy.Join{Table: "flights", On: "plane_id"})
+	if err != nil || len(plane.Flights) != 2 || plane.Flights[0].PlaneId != spitfire {
+		t.Error("Expected the Spitfire with its flights, got ", plane, err)
+	}
+
+	flight := Flight{}
+
+	err = tdb.FindWithRelated("flights", &flight, "1", ivy.Join{Table: "planes", Field: "plane_id", As: "plane"})
+	if err != nil || flight.Plane == nil || flight.Plane.Name != "Spitfire" {
+		t.Error("Expected the flight with its plane, got ", flight, err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	tdb := openTempDB(t, "foos", nil)
+	defer tdb.Close()
+
+	var recs []interface{}
+	for i := 0; i < 300; i++ {
+		recs = append(recs, Foo{Bar: fmt.Sprint("bar", i)})
+	}
+	tdb.CreateMany("foos", recs)
+
+	for _, snapshot := range []bool{false, true} {
+		cur, err := tdb.Scan("foos", &ivy.ScanOptions{Snapshot: snapshot})
+		if err != nil {
+			t.Fatal("Scan failed:", err)
+		}
+
+		n := 0
+		for cur.Next() {
+			foo := Foo{}
+			if err := cur.Decode(&foo); err != nil || foo.FileId != cur.Id() {
+				t.Error("Decode failed:", foo, err)
+			}
+			n++
+		}
+
+		if cur.Err() != nil || n != 300 {
+			t.Error("Expected 300 records, got ", n, cur.Err())
+		}
+		cur.Close()
+	}
+
+	cur, _ := tdb.Scan("foos", &ivy.ScanOptions{Snapshot: true})
+	cur.Next()
+	cur.Close()
+
+	// The snapshot lock must be released by Close.
+	_, err := tdb.Create("foos", Foo{Bar: "after"})
+	if err != nil {
+		t.Error("Create failed:", err)
+	}
+}
+
+func TestProjections(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.Mkdir(dir+"/planes", 0700); err != nil {
+		t.Fatal("Failed to create table dir:", err)
+	}
+
+	tdb, err := ivy.OpenDB(dir, map[string][]string{"planes": {"name"}})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	id, _ := tdb.Create("planes", map[string]interface{}{
+		"name":    "Spitfire",
+		"engine":  map[string]interface{}{"model": "Merlin", "hp": 1030},
+		"flights": []interface{}{map[string]interface{}{"code": "RAF1", "crew": 1}},
+	})
+
+	plane := Plane{}
+
+	err = tdb.FindProjected("planes", &plane, id, ivy.Projection{Include: []string{"name"}})
+	if err != nil || plane.Name != "Spitfire" || plane.FileId != id {
+		t.Error("Expected the plane name, got ", plane, err)
+	}
+
+	recs, err := tdb.FindAllProjected("planes", nil, ivy.Projection{Include: []string{"engine.model", "flights.code"}})
+	if err != nil || len(recs) != 1 {
+		t.Fatal("FindAllProjected failed:", recs, err)
+	}
+	if got := fmt.Sprint(recs[0].Record); got != "map[engine:map[model:Merlin] flights:[map[code:RAF1]]]" {
+		t.Error("Expected nested fields only, got ", got)
+	}
+
+	recs, _ = tdb.FindAllProjected("planes", []string{id}, ivy.Projection{Exclude: []string{"flights", "engine.hp"}})
+	if got := fmt.Sprint(recs[0].Record); got != "map[engine:map[model:Merlin] name:Spitfire]" {
+		t.Error("Expected excluded fields to be gone, got ", got)
+	}
+
+	// A projection on indexed fields is answered without reading the file.
+	ioutil.WriteFile(dir+"/planes/"+id+".json", []byte(`{"name":"changed behind our back"}`), 0600)
+
+	recs, _ = tdb.FindAllProjected("planes", nil, ivy.Projection{Include: []string{"name"}})
+	if recs[0].Record["name"] != "Spitfire" {
+		t.Error("Expected the name from the index, got ", recs[0].Record)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	rec := map[string]interface{}{
+		"name":  "Spitfire",
+		"big":   12345678901.0,
+		"speed": 594.5,
+		"tags":  []interface{}{"raf", nil, true, -40},
+		"crew":  map[string]interface{}{"pilot": "Ginger", "seats": 1},
+	}
+	want, _ := json.Marshal(rec)
+
+	codecs := []ivy.Codec{ivy.NewJSONCodec(), ivy.NewPrettyJSONCodec(), ivy.NewGobCodec(), ivy.NewMessagePackCodec()}
+
+	for _, codec := range codecs {
+		tdb := openTempDB(t, "planes", &ivy.TableOptions{Codec: codec})
+
+		id, err := tdb.Create("planes", rec)
+		if err != nil {
+			t.Fatal("Create failed:", codec.Ext(), err)
+		}
+
+		recs, _ := tdb.FindAllProjected("planes", nil, ivy.Projection{})
+		if len(recs) != 1 || recs[0].Id != id {
+			t.Fatal("Expected one record, got ", codec.Ext(), recs)
+		}
+
+		if got, _ := json.Marshal(recs[0].Record); string(got) != string(want) {
+			t.Error("Expected the record back unchanged, got ", codec.Ext(), string(got))
+		}
+
+		tdb.Close()
+	}
+
+	dir := t.TempDir()
+	os.Mkdir(dir+"/planes", 0700)
+
+	tdb, _ := ivy.OpenDB(dir, nil)
+	id, _ := tdb.Create("planes", Plane{Name: "Spitfire"})
+	tdb.Close()
+
+	tdb, _ = ivy.OpenDBWithOptions(dir, nil, map[string]*ivy.TableOptions{"planes": {Codec: ivy.NewMessagePackCodec()}})
+	defer tdb.Close()
+
+	n, err := tdb.MigrateCodec("planes", ivy.NewJSONCodec())
+	if err != nil || n != 1 {
+		t.Error("Expected one record migrated, got ", n, err)
+	}
+
+	plane := Plane{}
+
+	err = tdb.Find("planes", &plane, id)
+	if err != nil || plane.Name != "Spitfire" {
+		t.Error("Expected to find the migrated record, got ", plane, err)
+	}
+
+	if _, err := os.Stat(dir + "/planes/" + id + ".json"); !os.IsNotExist(err) {
+		t.Error("Expected the old json file to be removed, got ", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, algorithm := range []ivy.CompressionAlgorithm{ivy.Gzip, ivy.Zlib, ivy.Flate} {
+		dir := t.TempDir()
+		os.Mkdir(dir+"/docs", 0700)
+
+		tdb, _ := ivy.OpenDB(dir, map[string][]string{"docs": {"title"}})
+		big, _ := tdb.Create("docs", map[string]interface{}{"title": "big", "body": strings.Repeat("lorem ipsum ", 1000)})
+		tdb.Close()
+
+		opts := &ivy.TableOptions{Compression: &ivy.Compression{Algorithm: algorithm, Level: 9, Threshold: 256}}
+
+		tdb, err := ivy.OpenDBWithOptions(dir, map[string][]string{"docs": {"title"}}, map[string]*ivy.TableOptions{"docs": opts})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+
+		small, _ := tdb.Create("docs", map[string]interface{}{"title": "small"})
+
+		n, err := tdb.CompressTable("docs")
+		if err != nil || n != 1 {
+			t.Error("Expected one record compressed, got ", n, err)
+		}
+
+		info, _ := os.Stat(dir + "/docs/" + big + ".json")
+		if info.Size() > 1000 {
+			t.Error("Expected the big record to be compressed, got ", info.Size())
+		}
+
+		data, _ := ioutil.ReadFile(dir + "/docs/" + small + ".json")
+		if string(data) != `{"title":"small"}` {
+			t.Error("Expected the small record to be left alone, got ", string(data))
+		}
+
+		ids, _ := tdb.FindAllIdsForField("docs", "title", "big")
+		if len(ids) != 1 || ids[0] != big {
+			t.Error("Expected the compressed record to be indexed, got ", ids)
+		}
+
+		doc := map[string]interface{}{}
+		tdb.FindProjected("docs", &doc, big, ivy.Projection{Include: []string{"body"}})
+		if len(doc["body"].(string)) != 12000 {
+			t.Error("Expected the compressed record to read back, got ", len(doc["body"].(string)))
+		}
+
+		tdb.Close()
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/planes", 0700)
+
+	key1 := []byte("0123456789abcdef0123456789abcdef")
+	key2 := []byte("fedcba9876543210fedcba9876543210")
+
+	open := func(keys ivy.KeyProvider) *ivy.DB {
+		tdb, err := ivy.OpenDBWithOptions(dir, map[string][]string{"planes": {"name"}}, map[string]*ivy.TableOptions{
+			"planes": {Encryption: keys, History: true},
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+		return tdb
+	}
+
+	tdb := open(ivy.NewStaticKeyProvider(map[uint32][]byte{1: key1}, 1))
+	id, _ := tdb.Create("planes", Plane{Name: "Spitfire"})
+	tdb.Close()
+
+	data, _ := ioutil.ReadFile(dir + "/planes/" + id + ".json")
+	if strings.Contains(string(data), "Spitfire") {
+		t.Error("Expected the record file to be encrypted, got ", string(data))
+	}
+
+	tdb = open(ivy.NewStaticKeyProvider(map[uint32][]byte{1: key1, 2: key2}, 2))
+
+	ids, _ := tdb.FindAllIdsForField("planes", "name", "Spitfire")
+	if len(ids) != 1 {
+		t.Error("Expected the encrypted record to be indexed, got ", ids)
+	}
+
+	n, err := tdb.RotateKeys("planes")
+	if err != nil || n != 2 {
+		t.Error("Expected the record and its revision to be re-encrypted, got ", n, err)
+	}
+	tdb.Close()
+
+	tdb = open(ivy.NewStaticKeyProvider(map[uint32][]byte{2: key2}, 2))
+	defer tdb.Close()
+
+	plane := Plane{}
+
+	err = tdb.Find("planes", &plane, id)
+	if err != nil || plane.Name != "Spitfire" {
+		t.Error("Expected to read the record with the new key, got ", plane, err)
+	}
+
+	err = tdb.FindAtRevision("planes", &plane, id, 1)
+	if err != nil || plane.Name != "Spitfire" {
+		t.Error("Expected to read the revision with the new key, got ", plane, err)
+	}
+}
+
+func TestFieldEncryption(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	open := func(keys ivy.KeyProvider) *ivy.DB {
+		tdb, err := ivy.OpenDBWithOptions(dir, map[string][]string{"foos": {"bar", "tags"}}, map[string]*ivy.TableOptions{
+			"foos": {FieldEncryption: &ivy.FieldEncryption{
+				Fields:        []string{"bar"},
+				Keys:          keys,
+				BlindIndexKey: []byte("blind index key"),
+			}},
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+		return tdb
+	}
+
+	tdb := open(ivy.NewStaticKeyProvider(map[uint32][]byte{1: []byte("0123456789abcdef")}, 1))
+	id, _ := tdb.Create("foos", Foo{Bar: "123-45-6789", Tags: []string{"pii"}})
+
+	data, _ := ioutil.ReadFile(dir + "/foos/" + id + ".json")
+	if strings.Contains(string(data), "123-45-6789") || !strings.Contains(string(data), "pii") {
+		t.Error("Expected only the encrypted field to be hidden, got ", string(data))
+	}
+
+	ids, _ := tdb.FindAllIdsForField("foos", "bar", "123-45-6789")
+	if len(ids) != 1 || ids[0] != id {
+		t.Error("Expected to find the record by its blind index, got ", ids)
+	}
+
+	foo := Foo{}
+
+	err := tdb.Find("foos", &foo, id)
+	if err != nil || foo.Bar != "123-45-6789" {
+		t.Error("Expected the field to be decrypted, got ", foo, err)
+	}
+	tdb.Close()
+
+	tdb = open(nil)
+	defer tdb.Close()
+
+	foo = Foo{}
+
+	err = tdb.Find("foos", &foo, id)
+	if err != nil || foo.Bar != "" || len(foo.Tags) != 1 {
+		t.Error("Expected the field to be redacted without keys, got ", foo, err)
+	}
+
+	err = tdb.Update("foos", foo, id)
+	if !errors.Is(err, ivy.ErrKeyNotFound) {
+		t.Error("Expected ErrKeyNotFound writing without keys, got ", err)
+	}
+}
+
+func TestFieldEncryptionForgedValue(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	open := func() (*ivy.DB, error) {
+		return ivy.OpenDBWithOptions(dir, map[string][]string{"foos": {"bar"}}, map[string]*ivy.TableOptions{
+			"foos": {FieldEncryption: &ivy.FieldEncryption{
+				Fields: []string{"bar"},
+				Keys:   ivy.NewStaticKeyProvider(map[uint32][]byte{1: []byte("0123456789abcdef")}, 1),
+			}},
+		})
+	}
+
+	tdb, err := open()
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+
+	// A value shaped like an encrypted field is still the caller's value.
+	forged := map[string]interface{}{"$ivy_enc": "Zm9yZ2Vk", "$ivy_key": 1}
+
+	id, err := tdb.Create("foos", map[string]interface{}{"bar": forged})
+	if err != nil {
+		t.Fatal("Create failed:", err)
+	}
+	tdb.Close()
+
+	data, _ := ioutil.ReadFile(dir + "/foos/" + id + ".json")
+	if strings.Contains(string(data), "Zm9yZ2Vk") {
+		t.Error("Expected the forged value to be encrypted, got ", string(data))
+	}
+
+	tdb, err = open()
+	if err != nil {
+		t.Fatal("Expected the database to open after a forged value was written, got ", err)
+	}
+	tdb.Close()
+}
+
+func TestFieldEncryptionHistory(t *testing.T) {
+	tdb := openTempDB(t, "foos", &ivy.TableOptions{
+		History:    true,
+		SoftDelete: true,
+		FieldEncryption: &ivy.FieldEncryption{
+			Fields: []string{"bar"},
+			Keys:   ivy.NewStaticKeyProvider(map[uint32][]byte{1: []byte("0123456789abcdef")}, 1),
+		},
+	})
+	defer tdb.Close()
+
+	id, _ := tdb.Create("foos", Foo{Bar: "secret"})
+	tdb.Delete("foos", id)
+
+	err := tdb.Restore("foos", id)
+	if err != nil {
+		t.Fatal("Restore failed:", err)
+	}
+
+	revs, _ := tdb.History("foos", id)
+	for _, rev := range revs {
+		if rev.Deleted {
+			continue
+		}
+
+		foo := Foo{}
+
+		err = tdb.FindAtRevision("foos", &foo, id, rev.Rev)
+		if err != nil || foo.Bar != "secret" {
+			t.Error("Expected revision ", rev.Rev, " to hold the decrypted field, got ", foo, err)
+		}
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	open := func(quarantine bool) (*ivy.DB, error) {
+		return ivy.OpenDBWithOptions(dir, map[string][]string{"foos": {"bar"}}, map[string]*ivy.TableOptions{
+			"foos": {Checksums: true, QuarantineCorrupt: quarantine},
+		})
+	}
+
+	tdb, err := open(true)
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	good, _ := tdb.Create("foos", Foo{Bar: "good"})
+	bad, _ := tdb.Create("foos", Foo{Bar: "bad"})
+	tdb.Close()
+
+	// Flip a bit in the middle of the second record.
+	filename := dir + "/foos/" + bad + ".json"
+	data, _ := ioutil.ReadFile(filename)
+	data[len(data)-3] ^= 1
+	ioutil.WriteFile(filename, data, 0600)
+
+	_, err = open(false)
+	if !errors.Is(err, ivy.ErrCorrupt) {
+		t.Error("Expected ErrCorrupt opening without quarantine, got ", err)
+	}
+
+	tdb, err = open(true)
+	if err != nil {
+		t.Fatal("Expected the corrupt record to be quarantined, got ", err)
+	}
+	defer tdb.Close()
+
+	ids, _ := tdb.FindAllIds("foos")
+	if len(ids) != 1 || ids[0] != good {
+		t.Error("Expected only the good record to remain, got ", ids)
+	}
+
+	corrupt, _ := tdb.CorruptRecords("foos")
+	if len(corrupt) != 1 || corrupt[0].Id != bad || !strings.Contains(corrupt[0].Reason, "checksum") {
+		t.Error("Expected the corrupt record to be reported, got ", corrupt)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	tdb, err := ivy.OpenDB(dir, map[string][]string{"foos": {"bar"}})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	tdb.Create("foos", Foo{Bar: "one"})
+	gone, _ := tdb.Create("foos", Foo{Bar: "two"})
+
+	// Damage the table behind Ivy's back.
+	os.Remove(dir + "/foos/" + gone + ".json")
+	ioutil.WriteFile(dir+"/foos/9.json", []byte(`{"bar": "tru`), 0600)
+	ioutil.WriteFile(dir+"/foos/abc.json", []byte(`{"bar": "abc"}`), 0600)
+	ioutil.WriteFile(dir+"/foos/.sequence.tmp", []byte("3"), 0600)
+
+	kinds := func(report *ivy.CheckReport) map[ivy.ProblemKind]int {
+		found := make(map[ivy.ProblemKind]int)
+		for _, p := range report.Problems {
+			if !p.Repaired {
+				found[p.Kind]++
+			}
+		}
+		return found
+	}
+
+	report, err := tdb.Check()
+	if err != nil {
+		t.Fatal("Check failed:", err)
+	}
+	found := kinds(report)
+	if found[ivy.ProblemCorrupt] != 1 || found[ivy.ProblemIndex] != 2 || found[ivy.ProblemTempFile] != 1 || found[ivy.ProblemBadId] != 1 {
+		t.Error("Expected corrupt, index, temp file and bad id problems, got ", report.Problems)
+	}
+
+	report, err = tdb.Repair()
+	if err != nil {
+		t.Fatal("Repair failed:", err)
+	}
+	found = kinds(report)
+	if len(found) != 1 || found[ivy.ProblemBadId] != 1 {
+		t.Error("Expected only the bad id to be left unrepaired, got ", report.Problems)
+	}
+
+	report, _ = tdb.Check()
+	if len(report.Problems) != 1 || report.OK() {
+		t.Error("Expected only the bad id after repairing, got ", report.Problems)
+	}
+
+	ids, _ := tdb.FindAllIdsForField("foos", "bar", "abc")
+	if len(ids) != 1 {
+		t.Error("Expected the rebuilt index to hold the new record, got ", ids)
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	fieldsToIndex := map[string][]string{"foos": {"bar"}}
+
+	ioutil.WriteFile(dir+"/foos/1.json", []byte(`{"bar": "one"}`), 0600)
+	ioutil.WriteFile(dir+"/foos/2.json", []byte(`{"bar": "tw`), 0600)
+
+	_, err := ivy.OpenDB(dir, fieldsToIndex)
+	if err == nil {
+		t.Fatal("Expected OpenDB to fail on the corrupt record")
+	}
+
+	report, err := ivy.CheckPath(dir, fieldsToIndex, nil, false)
+	if err != nil {
+		t.Fatal("CheckPath failed:", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != ivy.ProblemCorrupt || report.Problems[0].Id != "2" {
+		t.Error("Expected record 2 to be reported corrupt, got ", report.Problems)
+	}
+
+	report, err = ivy.CheckPath(dir, fieldsToIndex, nil, true)
+	if err != nil || !report.OK() {
+		t.Fatal("Expected CheckPath to repair the database, got ", report.Problems, err)
+	}
+
+	tdb, err := ivy.OpenDB(dir, fieldsToIndex)
+	if err != nil {
+		t.Fatal("Expected the repaired database to open, got ", err)
+	}
+	tdb.Close()
+}
+
+func TestCheckPathEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+	os.Mkdir(dir+"/secrets", 0700)
+
+	keys := ivy.NewStaticKeyProvider(map[uint32][]byte{1: []byte("0123456789abcdef")}, 1)
+
+	tdb, err := ivy.OpenDBWithOptions(dir, nil, map[string]*ivy.TableOptions{
+		"foos":    {},
+		"secrets": {Encryption: keys},
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	tdb.Create("foos", Foo{Bar: "plain"})
+	tdb.Create("secrets", Foo{Bar: "hidden"})
+	tdb.Close()
+
+	// Without the key, the encrypted table is skipped and the others checked.
+	report, err := ivy.CheckPath(dir, map[string][]string{"foos": {"bar"}}, nil, false)
+	if err != nil {
+		t.Fatal("CheckPath failed:", err)
+	}
+	if report.Tables != 2 || len(report.Problems) != 1 || report.Problems[0].Table != "secrets" || report.Problems[0].Kind != ivy.ProblemUnreadable {
+		t.Error("Expected only the encrypted table to be reported unreadable, got ", report.Tables, report.Problems)
+	}
+
+	report, err = ivy.CheckPath(dir, nil, map[string]*ivy.TableOptions{"secrets": {Encryption: keys}}, false)
+	if err != nil || len(report.Problems) != 0 {
+		t.Error("Expected a clean report with the key, got ", report, err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	tdb, err := ivy.OpenDB(dir, map[string][]string{"foos": {"bar"}})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer tdb.Close()
+
+	kept, _ := tdb.Create("foos", Foo{Bar: "kept"})
+	doomed, _ := tdb.Create("foos", Foo{Bar: "doomed"})
+	tdb.Create("foos", Foo{Bar: "last"})
+
+	var full, incr bytes.Buffer
+
+	manifest, err := tdb.Backup(&full, &ivy.BackupOptions{Gzip: true})
+	if err != nil || len(manifest.Files) != 3 {
+		t.Fatal("Expected a full backup of three files, got ", manifest, err)
+	}
+
+	tdb.Update("foos", Foo{Bar: "changed"}, kept)
+	tdb.Delete("foos", doomed)
+	added, _ := tdb.Create("foos", Foo{Bar: "added"})
+
+	_, err = tdb.Backup(&incr, &ivy.BackupOptions{Since: manifest.Time})
+	if err != nil {
+		t.Fatal("Incremental backup failed:", err)
+	}
+
+	restored := t.TempDir() + "/restored"
+
+	if _, err := ivy.Restore(&full, restored); err != nil {
+		t.Fatal("Failed to restore the full backup:", err)
+	}
+	if _, err := ivy.Restore(&incr, restored); err != nil {
+		t.Fatal("Failed to restore the incremental backup:", err)
+	}
+
+	rdb, err := ivy.OpenDB(restored, map[string][]string{"foos": {"bar"}})
+	if err != nil {
+		t.Fatal("Failed to open the restored database:", err)
+	}
+	defer rdb.Close()
+
+	ids, _ := rdb.FindAllIds("foos")
+	if len(ids) != 3 {
+		t.Error("Expected the restored table to hold three records, got ", ids)
+	}
+
+	foo := Foo{}
+
+	err = rdb.Find("foos", &foo, kept)
+	if err != nil || foo.Bar != "changed" {
+		t.Error("Expected the restored record to have its latest value, got ", foo, err)
+	}
+
+	err = rdb.Find("foos", &foo, added)
+	if err != nil || foo.Bar != "added" {
+		t.Error("Expected the added record to be restored, got ", foo, err)
+	}
+
+	err = rdb.Find("foos", &foo, doomed)
+	if err == nil {
+		t.Error("Expected the deleted record to be removed, got ", foo)
+	}
+
+	_, err = ivy.Restore(strings.NewReader("not a backup"), restored)
+	if !errors.Is(err, ivy.ErrBadBackup) {
+		t.Error("Expected ErrBadBackup, got ", err)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	open := func(segments *ivy.SegmentOptions) *ivy.DB {
+		tdb, err := ivy.OpenDBWithOptions(dir, map[string][]string{"foos": {"bar"}}, map[string]*ivy.TableOptions{
+			"foos": {Segments: segments},
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+		return tdb
+	}
+
+	segments := &ivy.SegmentOptions{MaxSegmentSize: 256, CompactRatio: -1}
+
+	tdb := open(nil)
+	for _, bar := range []string{"one", "two", "three"} {
+		tdb.Create("foos", Foo{Bar: bar})
+	}
+	tdb.Close()
+
+	tdb = open(segments)
+	n, err := tdb.ConvertStorage("foos")
+	if err != nil || n != 3 {
+		t.Fatal("Expected three records to be converted to segments, got ", n, err)
+	}
+	if _, err := os.Stat(dir + "/foos/1.json"); !os.IsNotExist(err) {
+		t.Error("Expected the record files to be removed, got ", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		tdb.Update("foos", Foo{Bar: fmt.Sprint("one", i)}, "1")
+	}
+	tdb.Delete("foos", "2")
+
+	err = tdb.CompactTable("foos")
+	if err != nil {
+		t.Error("Failed to compact the table:", err)
+	}
+
+	segs, _ := ioutil.ReadDir(dir + "/foos/_segments")
+	if len(segs) != 1 {
+		t.Error("Expected compaction to leave a single segment, got ", len(segs))
+	}
+	tdb.Close()
+
+	// A torn write at the end of the newest segment is cut off on open.
+	f, _ := os.OpenFile(dir+"/foos/_segments/"+segs[0].Name(), os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 0, 1, 0, 0})
+	f.Close()
+
+	tdb = open(segments)
+
+	ids, _ := tdb.FindAllIdsForField("foos", "bar", "one19")
+	if len(ids) != 1 || ids[0] != "1" {
+		t.Error("Expected the latest value to be indexed, got ", ids)
+	}
+
+	cur, _ := tdb.Scan("foos", nil)
+	count := 0
+	for cur.Next() {
+		count++
+	}
+	cur.Close()
+	if count != 2 {
+		t.Error("Expected to scan two records, got ", count)
+	}
+	tdb.Close()
+
+	tdb = open(nil)
+	defer tdb.Close()
+
+	n, err = tdb.ConvertStorage("foos")
+	if err != nil || n != 2 {
+		t.Error("Expected two records to be converted back to files, got ", n, err)
+	}
+
+	foo := Foo{}
+
+	err = tdb.Find("foos", &foo, "3")
+	if err != nil || foo.Bar != "three" {
+		t.Error("Expected to find the record in its own file again, got ", foo, err)
+	}
+}
+
+func TestSegmentChecksum(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	fieldsToIndex := map[string][]string{"foos": {"bar"}}
+
+	open := func(quarantine bool) (*ivy.DB, error) {
+		return ivy.OpenDBWithOptions(dir, fieldsToIndex, map[string]*ivy.TableOptions{
+			"foos": {Segments: &ivy.SegmentOptions{}, QuarantineCorrupt: quarantine},
+		})
+	}
+
+	tdb, err := open(false)
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	tdb.Create("foos", Foo{Bar: "one"})
+	tdb.Create("foos", Foo{Bar: "two"})
+	tdb.Close()
+
+	// Damage the data of the last, complete entry of the newest segment.
+	filename := dir + "/foos/_segments/000001.seg"
+	data, _ := ioutil.ReadFile(filename)
+	data[len(data)-5] ^= 0xff
+	ioutil.WriteFile(filename, data, 0600)
+
+	_, err = open(false)
+	if !errors.Is(err, ivy.ErrCorrupt) {
+		t.Error("Expected ErrCorrupt opening without quarantine, got ", err)
+	}
+
+	after, _ := ioutil.ReadFile(filename)
+	if len(after) != len(data) {
+		t.Error("Expected the damaged entry not to be cut off, got ", len(after), " bytes")
+	}
+
+	report, err := ivy.CheckPath(dir, fieldsToIndex, map[string]*ivy.TableOptions{"foos": {Segments: &ivy.SegmentOptions{}}}, false)
+	if err != nil || len(report.Problems) != 1 || report.Problems[0].Kind != ivy.ProblemCorrupt || report.Problems[0].Id != "2" {
+		t.Error("Expected check to report record 2 corrupt, got ", report, err)
+	}
+
+	tdb, err = open(true)
+	if err != nil {
+		t.Fatal("Expected the damaged entry to be quarantined, got ", err)
+	}
+	defer tdb.Close()
+
+	ids, _ := tdb.FindAllIds("foos")
+	if len(ids) != 1 || ids[0] != "1" {
+		t.Error("Expected only record 1 to remain, got ", ids)
+	}
+
+	corrupt, _ := tdb.CorruptRecords("foos")
+	if len(corrupt) != 1 || corrupt[0].Id != "2" || !strings.Contains(corrupt[0].Reason, "checksum") {
+		t.Error("Expected record 2 to be reported quarantined, got ", corrupt)
+	}
+}
+
+func TestSegmentsCreateMany(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir+"/foos", 0700)
+
+	open := func() *ivy.DB {
+		tdb, err := ivy.OpenDBWithOptions(dir, map[string][]string{"foos": {"bar"}}, map[string]*ivy.TableOptions{
+			"foos": {Segments: &ivy.SegmentOptions{MaxSegmentSize: 512}},
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+		return tdb
+	}
+
+	tdb := open()
+
+	var recs []interface{}
+	for i := 0; i < 200; i++ {
+		recs = append(recs, Foo{Bar: fmt.Sprint("bulk", i)})
+	}
+
+	ids, err := tdb.CreateMany("foos", recs)
+	if err != nil || len(ids) != 200 {
+		t.Fatal("CreateMany failed:", len(ids), err)
+	}
+	tdb.Close()
+
+	// Every entry written by the concurrent bulk writers survives a reopen.
+	tdb = open()
+	defer tdb.Close()
+
+	for i, id := range ids {
+		foo := Foo{}
+
+		err = tdb.Find("foos", &foo, id)
+		if err != nil || foo.Bar != fmt.Sprint("bulk", i) {
+			t.Fatal("Expected to find ", fmt.Sprint("bulk", i), " at ", id, ", got ", foo, err)
+		}
+	}
+}
+
 //=============================================================================
 // Setup Stuff
 //=============================================================================
@@ -158,3 +2214,125 @@ func (foo *Foo) AfterFind(db *ivy.DB, fileId string) {
 
 	foo.FileId = fileId
 }
+
+type HookedFoo struct {
+	Bar  string   `json:"bar"`
+	Tags []string `json:"tags"`
+}
+
+func (foo *HookedFoo) BeforeCreate(db *ivy.DB, fileId string) error {
+	foo.Tags = append(foo.Tags, "created")
+	return nil
+}
+
+func (foo *HookedFoo) Validate() error {
+	if foo.Bar == "" {
+		return errors.New("bar is required")
+	}
+	return nil
+}
+
+type DeletableFoo struct {
+	Bar       string `json:"bar"`
+	DeletedId string `json:"-"`
+}
+
+func (foo *DeletableFoo) AfterFind(db *ivy.DB, fileId string) {
+	*foo = DeletableFoo(*foo)
+}
+
+func (foo *DeletableFoo) BeforeDelete(db *ivy.DB, fileId string) error {
+	if foo.Bar == "keep" {
+		return errors.New("this record is kept")
+	}
+	return nil
+}
+
+func (foo *DeletableFoo) AfterDelete(db *ivy.DB, fileId string) {
+	foo.DeletedId = fileId
+}
+
+type StampedFoo struct {
+	Bar       string    `json:"bar"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (foo *StampedFoo) AfterFind(db *ivy.DB, fileId string) {
+	*foo = StampedFoo(*foo)
+}
+
+type Doc struct {
+	FileId    string    `json:"-"`
+	Name      string    `json:"name"`
+	Embedding []float64 `json:"embedding"`
+}
+
+func (doc *Doc) AfterFind(db *ivy.DB, fileId string) {
+	*doc = Doc(*doc)
+
+	doc.FileId = fileId
+}
+
+type Plane struct {
+	FileId  string   `json:"-"`
+	Name    string   `json:"name"`
+	Flights []Flight `json:"flights,omitempty"`
+}
+
+func (plane *Plane) AfterFind(db *ivy.DB, fileId string) {
+	*plane = Plane(*plane)
+
+	plane.FileId = fileId
+}
+
+type Flight struct {
+	FileId  string `json:"-"`
+	Code    string `json:"code"`
+	PlaneId string `json:"plane_id"`
+	Plane   *Plane `json:"plane,omitempty"`
+}
+
+func (flight *Flight) AfterFind(db *ivy.DB, fileId string) {
+	*flight = Flight(*flight)
+
+	flight.FileId = fileId
+}
+
+type Airfield struct {
+	FileId string  `json:"-"`
+	Name   string  `json:"name"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+}
+
+func (airfield *Airfield) AfterFind(db *ivy.DB, fileId string) {
+	*airfield = Airfield(*airfield)
+
+	airfield.FileId = fileId
+}
+
+// openTempDB opens a database in a fresh temporary directory holding a single
+// table with the supplied options.
+// fixedIdGenerator hands out the same id every time.
+type fixedIdGenerator string
+
+func (g fixedIdGenerator) NextId(tblPath string) (string, error) {
+	return string(g), nil
+}
+
+func openTempDB(t *testing.T, tblName string, opts *ivy.TableOptions) *ivy.DB {
+	dir := t.TempDir()
+
+	err := os.Mkdir(dir+"/"+tblName, 0700)
+	if err != nil {
+		t.Fatal("Failed to create table dir:", err)
+	}
+
+	tdb, err := ivy.OpenDBWithOptions(dir, nil, map[string]*ivy.TableOptions{tblName: opts})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+
+	return tdb
+}
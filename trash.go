@@ -0,0 +1,151 @@
+package ivy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// trashDir is the name of the directory, inside a table directory, that soft
+// deleted records are moved to.
+const trashDir = "_trash"
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// FindDeletedIds returns the ids of all soft deleted records of a table.
+// It takes a table name. It returns a slice of ids and any error encountered.
+func (db *DB) FindDeletedIds(tblName string) ([]string, error) {
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	return fileIdsInDir(db.trashPath(tblName), db.codec(tblName).Ext()), nil
+}
+
+// Restore brings a soft deleted record back into its table.
+// It takes a table name and the record id. It returns ErrNotFound if the
+// record is not in the trash, ErrExists if a live record has since been created
+// with the same id, or any other error encountered.
+func (db *DB) Restore(tblName string, fileId string) error {
+	if !validFileId(fileId) {
+		return ErrInvalidId
+	}
+
+	db.rwLocks[tblName].Lock()
+	defer db.rwLocks[tblName].Unlock()
+
+	trashed := db.trashFilePath(tblName, fileId)
+
+	if _, err := os.Stat(trashed); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+
+	if db.recExists(tblName, fileId) && !db.isExpired(tblName, fileId) {
+		return ErrExists
+	}
+
+	err := db.store(tblName).moveIn(fileId, trashed)
+	if err != nil {
+		return err
+	}
+
+	// The record is back even if its revision cannot be saved, so the indexes
+	// are rebuilt either way.
+	if db.options(tblName).History {
+		var data []byte
+
+		data, err = db.readSealedRec(tblName, fileId)
+		if err == nil {
+			err = db.saveRevision(tblName, fileId, data)
+		}
+	}
+
+	if indexErr := db.initTblIndexes(tblName); err == nil {
+		err = indexErr
+	}
+
+	return err
+}
+
+// Purge permanently removes a soft deleted record.
+// It takes a table name and the record id. It returns ErrNotFound if the
+// record is not in the trash, or any other error encountered.
+func (db *DB) Purge(tblName string, fileId string) error {
+	if !validFileId(fileId) {
+		return ErrInvalidId
+	}
+
+	db.rwLocks[tblName].Lock()
+	defer db.rwLocks[tblName].Unlock()
+
+	err := os.Remove(db.trashFilePath(tblName, fileId))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// PurgeDeleted permanently removes the soft deleted records of a table that
+// were deleted more than a given duration ago. Pass zero to empty the trash.
+// It takes a table name and the minimum age. It returns the number of records
+// purged and any error encountered.
+func (db *DB) PurgeDeleted(tblName string, olderThan time.Duration) (int, error) {
+	purged := 0
+
+	db.rwLocks[tblName].Lock()
+	defer db.rwLocks[tblName].Unlock()
+
+	files, _ := ioutil.ReadDir(db.trashPath(tblName))
+	cutoff := time.Now().Add(-olderThan)
+
+	for _, file := range files {
+		if file.IsDir() || file.ModTime().After(cutoff) {
+			continue
+		}
+
+		err := os.Remove(path.Join(db.trashPath(tblName), file.Name()))
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// trashRec moves a record file into the table's trash, stamping it with the
+// time of deletion. The caller must hold the table's write lock.
+func (db *DB) trashRec(tblName string, fileId string) error {
+	err := os.MkdirAll(db.trashPath(tblName), 0700)
+	if err != nil {
+		return err
+	}
+
+	trashed := db.trashFilePath(tblName, fileId)
+
+	err = db.store(tblName).moveOut(fileId, trashed)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	return os.Chtimes(trashed, now, now)
+}
+
+// trashPath returns the trash directory of a table.
+func (db *DB) trashPath(tblName string) string {
+	return path.Join(db.tblPath(tblName), trashDir)
+}
+
+// trashFilePath returns the file name of a trashed record.
+func (db *DB) trashFilePath(tblName string, fileId string) string {
+	return path.Join(db.trashPath(tblName), fileId+db.codec(tblName).Ext())
+}
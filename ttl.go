@@ -0,0 +1,374 @@
+package ivy
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ExpiresAtField is the field Ivy stores a record's expiry time in, as an
+// RFC 3339 UTC time.
+const ExpiresAtField = "expires_at"
+
+// defaultReapInterval is how often the background reaper removes expired
+// records from tables that do not set TableOptions.ReapInterval.
+const defaultReapInterval = time.Minute
+
+// ErrNotExpiring is returned by Expire for tables that do not have
+// TableOptions.TTL or TableOptions.Expiring set.
+var ErrNotExpiring = errors.New("ivy: table does not track expiry")
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// Expire sets a record to expire after a duration, overriding the table's
+// default TTL until the record is next written. Pass zero to make the record
+// never expire. It takes a table name, the record id and the time to live. It
+// returns ErrNotExpiring if the table does not track expiry, ErrNotFound if
+// there is no live record with that id, or any other error encountered.
+func (db *DB) Expire(tblName string, fileId string, ttl time.Duration) error {
+	if !validFileId(fileId) {
+		return ErrInvalidId
+	}
+
+	if !db.expiring(tblName) {
+		return ErrNotExpiring
+	}
+
+	db.rwLocks[tblName].Lock()
+	defer db.rwLocks[tblName].Unlock()
+
+	if db.isExpired(tblName, fileId) {
+		return ErrNotFound
+	}
+
+	rec, err := db.loadRecMap(tblName, fileId)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if ttl > 0 {
+		rec[ExpiresAtField] = time.Now().Add(ttl).UTC().Format(time.RFC3339Nano)
+	} else {
+		delete(rec, ExpiresAtField)
+	}
+
+	marshalledRec, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	err = db.writeRaw(tblName, fileId, marshalledRec)
+	if err != nil {
+		return err
+	}
+
+	db.trackExpiry(tblName, fileId, rec)
+
+	return nil
+}
+
+// ReapExpired removes the expired records of a table straight away, instead of
+// waiting for the background reaper. It takes a table name. It returns the
+// number of records removed and any error encountered.
+func (db *DB) ReapExpired(tblName string) (int, error) {
+	db.rwLocks[tblName].Lock()
+	defer db.rwLocks[tblName].Unlock()
+
+	return db.reapTbl(tblName)
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// expiring answers whether a table tracks record expiry.
+func (db *DB) expiring(tblName string) bool {
+	opts := db.options(tblName)
+	return opts.TTL > 0 || opts.Expiring
+}
+
+// isExpired answers whether a record has passed its expiry time.
+func (db *DB) isExpired(tblName string, fileId string) bool {
+	db.expiryMu.Lock()
+	defer db.expiryMu.Unlock()
+
+	expiresAt, ok := db.expiries[tblName][fileId]
+	return ok && !time.Now().Before(expiresAt)
+}
+
+// liveIds filters the expired records out of a slice of ids. It returns the
+// slice itself when nothing in the table can expire.
+func (db *DB) liveIds(tblName string, ids []string) []string {
+	db.expiryMu.Lock()
+	defer db.expiryMu.Unlock()
+
+	if len(db.expiries[tblName]) == 0 {
+		return ids
+	}
+
+	now := time.Now()
+	live := make([]string, 0, len(ids))
+
+	for _, fileId := range ids {
+		if expiresAt, ok := db.expiries[tblName][fileId]; !ok || now.Before(expiresAt) {
+			live = append(live, fileId)
+		}
+	}
+
+	return live
+}
+
+// expiredCount returns how many records of a table have expired but not yet
+// been reaped.
+func (db *DB) expiredCount(tblName string) int {
+	db.expiryMu.Lock()
+	defer db.expiryMu.Unlock()
+
+	n := 0
+	now := time.Now()
+
+	for _, expiresAt := range db.expiries[tblName] {
+		if !now.Before(expiresAt) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// liveVectorMatches filters the expired records out of nearest neighbour
+// matches and keeps at most k of them.
+func (db *DB) liveVectorMatches(tblName string, matches []VectorMatch, k int) []VectorMatch {
+	live := matches[:0]
+
+	for _, m := range matches {
+		if !db.isExpired(tblName, m.Id) {
+			live = append(live, m)
+		}
+	}
+
+	if len(live) > k {
+		live = live[:k]
+	}
+
+	return live
+}
+
+// liveGeoMatches filters the expired records out of geo matches.
+func (db *DB) liveGeoMatches(tblName string, matches []GeoMatch) []GeoMatch {
+	live := matches[:0]
+
+	for _, m := range matches {
+		if !db.isExpired(tblName, m.Id) {
+			live = append(live, m)
+		}
+	}
+
+	return live
+}
+
+// notFoundErr returns the error Find gives for a missing record file, for use
+// with expired records.
+func (db *DB) notFoundErr(tblName string, fileId string) error {
+	return &os.PathError{Op: "open", Path: db.filePath(tblName, fileId), Err: os.ErrNotExist}
+}
+
+// initExpiryIndex rebuilds the in-memory expiry times of a table's records.
+func (db *DB) initExpiryIndex(tblName string) error {
+	expiries := make(map[string]time.Time)
+
+	for _, fileId := range db.fileIdsInDataDir(tblName) {
+		rec, err := db.loadRecMap(tblName, fileId)
+		if err != nil {
+			return err
+		}
+
+		if expiresAt, ok := expiryOf(rec); ok {
+			expiries[fileId] = expiresAt
+		}
+	}
+
+	db.expiryMu.Lock()
+	db.expiries[tblName] = expiries
+	db.expiryMu.Unlock()
+
+	return nil
+}
+
+// stampExpiry sets the expiry time of a record about to be written: the
+// table's TTL from now if it has one, otherwise the expiry of oldRec, the
+// record it replaces, if it had one.
+func (db *DB) stampExpiry(tblName string, rec map[string]interface{}, oldRec map[string]interface{}) {
+	if ttl := db.options(tblName).TTL; ttl > 0 {
+		rec[ExpiresAtField] = time.Now().Add(ttl).UTC().Format(time.RFC3339Nano)
+	} else if _, ok := rec[ExpiresAtField]; !ok {
+		if expiresAt, ok := oldRec[ExpiresAtField]; ok {
+			rec[ExpiresAtField] = expiresAt
+		}
+	}
+}
+
+// trackExpiry records the expiry time of a record in the in-memory index.
+func (db *DB) trackExpiry(tblName string, fileId string, rec map[string]interface{}) {
+	db.expiryMu.Lock()
+	defer db.expiryMu.Unlock()
+
+	if db.expiries[tblName] == nil {
+		db.expiries[tblName] = make(map[string]time.Time)
+	}
+
+	if expiresAt, ok := expiryOf(rec); ok {
+		db.expiries[tblName][fileId] = expiresAt
+	} else {
+		delete(db.expiries[tblName], fileId)
+	}
+}
+
+// reapTbl physically removes every expired record of a table and rebuilds the
+// table's indexes. If a record cannot be removed it stops there, still
+// rebuilding the indexes for the records already removed. It returns the
+// number of records removed and any error encountered. The caller must hold
+// the table's write lock.
+func (db *DB) reapTbl(tblName string) (int, error) {
+	var expired []string
+	var err error
+
+	now := time.Now()
+
+	db.expiryMu.Lock()
+	for fileId, expiresAt := range db.expiries[tblName] {
+		if !now.Before(expiresAt) {
+			expired = append(expired, fileId)
+		}
+	}
+	db.expiryMu.Unlock()
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	sort.Strings(expired)
+
+	removed := 0
+
+	for _, fileId := range expired {
+		// Like removeRec, save the deletion to the history first.
+		if db.options(tblName).History {
+			err = db.saveRevision(tblName, fileId, nil)
+			if err != nil {
+				break
+			}
+		}
+
+		err = db.store(tblName).remove(fileId)
+		if err != nil && !os.IsNotExist(err) {
+			break
+		}
+		err = nil
+
+		db.expiryMu.Lock()
+		delete(db.expiries[tblName], fileId)
+		db.expiryMu.Unlock()
+
+		removed++
+	}
+
+	if removed > 0 {
+		if indexErr := db.initTblIndexes(tblName); err == nil {
+			err = indexErr
+		}
+	}
+
+	return removed, err
+}
+
+// startReaper starts a goroutine for every table that tracks expiry, which
+// periodically removes the table's expired records. Close stops them.
+func (db *DB) startReaper() {
+	var tblNames []string
+
+	for _, tblName := range db.configuredTbls() {
+		if db.expiring(tblName) {
+			tblNames = append(tblNames, tblName)
+		}
+	}
+
+	if len(tblNames) == 0 {
+		return
+	}
+
+	db.stopReaper = make(chan struct{})
+	db.reaperDone = make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	for _, tblName := range tblNames {
+		wg.Add(1)
+		go func(tblName string) {
+			defer wg.Done()
+			db.reapLoop(tblName)
+		}(tblName)
+	}
+
+	go func() {
+		wg.Wait()
+		close(db.reaperDone)
+	}()
+}
+
+// reapLoop removes the expired records of a table every ReapInterval until the
+// reaper is stopped, handing any error to the table's OnReapError.
+func (db *DB) reapLoop(tblName string) {
+	interval := db.options(tblName).ReapInterval
+	if interval == 0 {
+		interval = defaultReapInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stopReaper:
+			return
+		case <-ticker.C:
+			_, err := db.ReapExpired(tblName)
+			if err == nil {
+				continue
+			}
+
+			if onErr := db.options(tblName).OnReapError; onErr != nil {
+				onErr(tblName, err)
+			} else {
+				log.Printf("ivy: reaping expired records from table %s: %v", tblName, err)
+			}
+		}
+	}
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// expiryOf returns the expiry time stored in a record, if it has one.
+func expiryOf(rec map[string]interface{}) (time.Time, bool) {
+	s, ok := rec[ExpiresAtField].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return expiresAt, true
+}
@@ -0,0 +1,560 @@
+package ivy
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Type Metric selects how the distance between two vectors is measured.
+type Metric int
+
+const (
+	// Cosine ranks vectors by the angle between them. Distance is 1 minus the
+	// cosine similarity.
+	Cosine Metric = iota
+	// DotProduct ranks vectors by inner product. Distance is the negated dot
+	// product, so larger products sort first.
+	DotProduct
+	// Euclidean ranks vectors by L2 distance.
+	Euclidean
+)
+
+// Type VectorIndex declares a vector index on a field holding a JSON array of
+// numbers. Exact indexes keep the vectors in memory and compare the query with
+// every one of them. Approximate indexes also build a Hierarchical Navigable
+// Small World (HNSW) graph, trading a little recall for much faster queries on
+// larger tables.
+type VectorIndex struct {
+	Field       string
+	Metric      Metric
+	Approximate bool
+
+	// M is the number of neighbours each graph node keeps per layer (default
+	// 16). EfConstruction and EfSearch size the candidate lists used while
+	// building and searching the graph (defaults 200 and 64).
+	M              int
+	EfConstruction int
+	EfSearch       int
+}
+
+// Type VectorMatch is a single result of a nearest-neighbour search.
+type VectorMatch struct {
+	Id       string
+	Distance float64
+}
+
+//*****************************************************************************
+// Public DB Methods
+//*****************************************************************************
+
+// FindNearestIds returns the k records whose vector field is closest to the
+// query vector. It takes a table name, the name of a numeric array field, the
+// query vector, the number of neighbours wanted and the metric to rank by. If
+// the field has an approximate vector index with the same metric and dimension
+// as the query it is used, otherwise every vector is compared (from memory when
+// the field has an index, from the record files when it has none). Records
+// whose vector has a different dimension than the query are skipped. It
+// returns the matches ordered from nearest to furthest and any error
+// encountered.
+func (db *DB) FindNearestIds(tblName string, searchField string, query []float64, k int, metric Metric) ([]VectorMatch, error) {
+	db.rwLocks[tblName].RLock()
+	defer db.rwLocks[tblName].RUnlock()
+
+	if k <= 0 {
+		return nil, nil
+	}
+
+	// Ask for enough extra neighbours to cover any expired records.
+	wanted := k + db.expiredCount(tblName)
+
+	if idx, ok := db.vecIndexes[tblName][searchField]; ok {
+		if idx.graph != nil && idx.spec.Metric == metric && idx.graph.dim == len(query) {
+			return db.liveVectorMatches(tblName, idx.graph.search(query, wanted, idx.spec.EfSearch), k), nil
+		}
+		return db.liveVectorMatches(tblName, nearest(idx.ids, idx.vecs, query, wanted, metric), k), nil
+	}
+
+	var ids []string
+	var vecs [][]float64
+
+	for _, fileId := range db.fileIdsInDataDir(tblName) {
+		rec, err := db.loadRecMap(tblName, fileId)
+		if err != nil {
+			return nil, err
+		}
+
+		if vec, ok := toVector(rec[searchField]); ok {
+			ids = append(ids, fileId)
+			vecs = append(vecs, vec)
+		}
+	}
+
+	return db.liveVectorMatches(tblName, nearest(ids, vecs, query, wanted, metric), k), nil
+}
+
+//*****************************************************************************
+// Private DB Methods
+//*****************************************************************************
+
+// vectorIndex holds the in-memory vectors of one field of a table and, for
+// approximate indexes, the HNSW graph built over them.
+type vectorIndex struct {
+	spec  VectorIndex
+	ids   []string
+	vecs  [][]float64
+	graph *hnsw
+}
+
+// initVectorIndexes initializes all vector indexes for a table.
+func (db *DB) initVectorIndexes(tblName string) error {
+	indexes := make(map[string]*vectorIndex)
+
+	for _, spec := range db.options(tblName).VectorIndexes {
+		indexes[spec.Field] = &vectorIndex{spec: withVectorDefaults(spec)}
+	}
+
+	// For every file in the data dir...
+	for _, fileId := range db.fileIdsInDataDir(tblName) {
+		rec, err := db.loadRecMap(tblName, fileId)
+		if err != nil {
+			return err
+		}
+
+		for fldName, idx := range indexes {
+			if vec, ok := toVector(rec[fldName]); ok {
+				idx.ids = append(idx.ids, fileId)
+				idx.vecs = append(idx.vecs, vec)
+			}
+		}
+	}
+
+	for _, idx := range indexes {
+		if idx.spec.Approximate {
+			idx.graph = newHNSW(idx.spec, idx.ids, idx.vecs)
+		}
+	}
+
+	db.vecIndexes[tblName] = indexes
+
+	return nil
+}
+
+// update replaces the vector of a record in the index, or removes the record
+// if ok is false. In an approximate index the record's old node is tombstoned
+// and its new vector linked in; the graph is only rebuilt from the vectors in
+// memory once it is empty or tombstones make up half of it.
+func (idx *vectorIndex) update(fileId string, vec []float64, ok bool) {
+	pos := -1
+	for i, id := range idx.ids {
+		if id == fileId {
+			pos = i
+			break
+		}
+	}
+
+	if pos >= 0 {
+		idx.ids = append(idx.ids[:pos:pos], idx.ids[pos+1:]...)
+		idx.vecs = append(idx.vecs[:pos:pos], idx.vecs[pos+1:]...)
+	}
+	if ok {
+		idx.ids = append(idx.ids, fileId)
+		idx.vecs = append(idx.vecs, vec)
+	}
+
+	if !idx.spec.Approximate || (pos < 0 && !ok) {
+		return
+	}
+
+	g := idx.graph
+	g.remove(fileId)
+
+	if g.live() == 0 || 2*g.dead >= len(g.ids) {
+		idx.graph = newHNSW(idx.spec, idx.ids, idx.vecs)
+		return
+	}
+
+	// Vectors of another dimension stay out of the graph until it is rebuilt.
+	if ok && len(vec) == g.dim {
+		g.add(fileId, vec)
+	}
+}
+
+//=============================================================================
+// HNSW
+//=============================================================================
+
+// hnsw is a Hierarchical Navigable Small World graph (Malkov & Yashunin). Every
+// vector lives on layer 0 and on each higher layer with exponentially falling
+// probability; searches descend greedily from the sparse top layer and then
+// run a best-first search on layer 0. Records are linked in as they are
+// written, and their old nodes tombstoned: still walked through, but never
+// returned. When the index is built, and once tombstones make up half of the
+// graph, it is built from scratch with a fixed seed, so results are
+// reproducible.
+type hnsw struct {
+	metric    Metric
+	dim       int
+	m         int
+	mMax0     int
+	efConst   int
+	levelMult float64
+	ids       []string
+	vecs      [][]float64
+	levels    []int
+	friends   [][][]int
+	deleted   []bool
+	nodeOf    map[string]int // live node of each record
+	dead      int
+	entry     int
+	maxLevel  int
+	rng       *rand.Rand
+}
+
+// newHNSW builds a graph over the supplied vectors that have the most common
+// dimension. Vectors of any other length cannot be compared with the rest and
+// are left out; exact searches still find them.
+func newHNSW(spec VectorIndex, ids []string, vecs [][]float64) *hnsw {
+	g := &hnsw{
+		metric:    spec.Metric,
+		dim:       commonDimension(vecs),
+		m:         spec.M,
+		mMax0:     2 * spec.M,
+		efConst:   spec.EfConstruction,
+		levelMult: 1 / math.Log(float64(spec.M)),
+		nodeOf:    make(map[string]int),
+		entry:     -1,
+		rng:       rand.New(rand.NewSource(1)),
+	}
+
+	for i, vec := range vecs {
+		if len(vec) != g.dim {
+			continue
+		}
+
+		g.add(ids[i], vec)
+	}
+
+	return g
+}
+
+// add links a new vector into the graph.
+func (g *hnsw) add(fileId string, vec []float64) {
+	g.ids = append(g.ids, fileId)
+	g.vecs = append(g.vecs, vec)
+	g.deleted = append(g.deleted, false)
+	g.nodeOf[fileId] = len(g.vecs) - 1
+	g.insert(len(g.vecs) - 1)
+}
+
+// remove tombstones the node of a record, if it has one.
+func (g *hnsw) remove(fileId string) {
+	if i, ok := g.nodeOf[fileId]; ok {
+		g.deleted[i] = true
+		delete(g.nodeOf, fileId)
+		g.dead++
+	}
+}
+
+// live returns the number of nodes that are not tombstoned.
+func (g *hnsw) live() int {
+	return len(g.ids) - g.dead
+}
+
+// insert links node i into the graph.
+func (g *hnsw) insert(i int) {
+	level := int(-math.Log(1-g.rng.Float64()) * g.levelMult)
+
+	g.levels = append(g.levels, level)
+	g.friends = append(g.friends, make([][]int, level+1))
+
+	if g.entry < 0 {
+		g.entry = i
+		g.maxLevel = level
+		return
+	}
+
+	q := g.vecs[i]
+	ep := g.entry
+
+	for l := g.maxLevel; l > level; l-- {
+		ep = g.greedy(q, ep, l)
+	}
+
+	for l := minInt(level, g.maxLevel); l >= 0; l-- {
+		candidates := g.searchLayer(q, []int{ep}, g.efConst, l)
+
+		mMax := g.m
+		if l == 0 {
+			mMax = g.mMax0
+		}
+
+		neighbours := candidates
+		if len(neighbours) > g.m {
+			neighbours = neighbours[:g.m]
+		}
+
+		for _, n := range neighbours {
+			g.friends[i][l] = append(g.friends[i][l], n.node)
+			g.friends[n.node][l] = append(g.friends[n.node][l], i)
+
+			if len(g.friends[n.node][l]) > mMax {
+				g.friends[n.node][l] = g.closest(g.vecs[n.node], g.friends[n.node][l], mMax)
+			}
+		}
+
+		ep = candidates[0].node
+	}
+
+	if level > g.maxLevel {
+		g.entry = i
+		g.maxLevel = level
+	}
+}
+
+// search returns the k approximate nearest neighbours of q. If tombstones
+// crowd out live nodes, the search is widened until k are found or the whole
+// graph has been searched.
+func (g *hnsw) search(q []float64, k int, ef int) []VectorMatch {
+	var matches []VectorMatch
+
+	if g.entry < 0 || len(q) != g.dim {
+		return nil
+	}
+
+	ep := g.entry
+	for l := g.maxLevel; l > 0; l-- {
+		ep = g.greedy(q, ep, l)
+	}
+
+	if ef < k {
+		ef = k
+	}
+
+	for {
+		matches = matches[:0]
+
+		for _, c := range g.searchLayer(q, []int{ep}, ef, 0) {
+			if len(matches) == k {
+				break
+			}
+			if !g.deleted[c.node] {
+				matches = append(matches, VectorMatch{Id: g.ids[c.node], Distance: c.dist})
+			}
+		}
+
+		if len(matches) == k || g.dead == 0 || ef >= len(g.ids) {
+			return matches
+		}
+		ef *= 2
+	}
+}
+
+// greedy walks a single layer towards q, returning the closest node found.
+func (g *hnsw) greedy(q []float64, ep int, level int) int {
+	best := ep
+	bestDist := distance(g.metric, q, g.vecs[ep])
+
+	for changed := true; changed; {
+		changed = false
+		for _, n := range g.friends[best][level] {
+			if d := distance(g.metric, q, g.vecs[n]); d < bestDist {
+				best, bestDist, changed = n, d, true
+			}
+		}
+	}
+
+	return best
+}
+
+// searchLayer runs a best-first search of one layer and returns up to ef nodes
+// sorted from nearest to furthest.
+func (g *hnsw) searchLayer(q []float64, eps []int, ef int, level int) []distItem {
+	visited := make(map[int]bool)
+	candidates := &distHeap{}
+	results := &distHeap{max: true}
+
+	for _, ep := range eps {
+		d := distance(g.metric, q, g.vecs[ep])
+		visited[ep] = true
+		heap.Push(candidates, distItem{ep, d})
+		heap.Push(results, distItem{ep, d})
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(distItem)
+		if results.Len() >= ef && c.dist > results.items[0].dist {
+			break
+		}
+
+		for _, n := range g.friends[c.node][level] {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+
+			d := distance(g.metric, q, g.vecs[n])
+			if results.Len() < ef || d < results.items[0].dist {
+				heap.Push(candidates, distItem{n, d})
+				heap.Push(results, distItem{n, d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	sorted := append([]distItem(nil), results.items...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].dist < sorted[j].dist })
+
+	return sorted
+}
+
+// closest returns the n nodes in a list that are nearest to q.
+func (g *hnsw) closest(q []float64, nodes []int, n int) []int {
+	items := make([]distItem, len(nodes))
+	for i, node := range nodes {
+		items[i] = distItem{node, distance(g.metric, q, g.vecs[node])}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].dist < items[j].dist })
+
+	kept := make([]int, 0, n)
+	for _, item := range items[:n] {
+		kept = append(kept, item.node)
+	}
+
+	return kept
+}
+
+// distItem pairs a graph node with its distance from the query.
+type distItem struct {
+	node int
+	dist float64
+}
+
+// distHeap is a min-heap of distItems, or a max-heap when max is set.
+type distHeap struct {
+	items []distItem
+	max   bool
+}
+
+func (h *distHeap) Len() int      { return len(h.items) }
+func (h *distHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *distHeap) Less(i, j int) bool {
+	if h.max {
+		return h.items[i].dist > h.items[j].dist
+	}
+	return h.items[i].dist < h.items[j].dist
+}
+func (h *distHeap) Push(x interface{}) { h.items = append(h.items, x.(distItem)) }
+func (h *distHeap) Pop() interface{} {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// withVectorDefaults fills in the zero tuning parameters of a vector index.
+func withVectorDefaults(spec VectorIndex) VectorIndex {
+	if spec.M < 2 {
+		spec.M = 16
+	}
+	if spec.EfConstruction <= 0 {
+		spec.EfConstruction = 200
+	}
+	if spec.EfSearch <= 0 {
+		spec.EfSearch = 64
+	}
+	return spec
+}
+
+// commonDimension returns the most common length of a set of vectors, the
+// earliest seen winning ties.
+func commonDimension(vecs [][]float64) int {
+	counts := make(map[int]int)
+	dim := 0
+
+	for _, vec := range vecs {
+		counts[len(vec)]++
+		if counts[len(vec)] > counts[dim] {
+			dim = len(vec)
+		}
+	}
+
+	return dim
+}
+
+// nearest does an exact nearest-neighbour search by comparing the query with
+// every vector.
+func nearest(ids []string, vecs [][]float64, query []float64, k int, metric Metric) []VectorMatch {
+	var matches []VectorMatch
+
+	for i, vec := range vecs {
+		if len(vec) != len(query) {
+			continue
+		}
+		matches = append(matches, VectorMatch{Id: ids[i], Distance: distance(metric, query, vec)})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Distance < matches[j].Distance })
+
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+
+	return matches
+}
+
+// distance measures two vectors of equal length with the given metric. Smaller
+// is always nearer.
+func distance(metric Metric, a, b []float64) float64 {
+	switch metric {
+	case DotProduct:
+		return -dot(a, b)
+	case Euclidean:
+		var sum float64
+		for i := range a {
+			d := a[i] - b[i]
+			sum += d * d
+		}
+		return math.Sqrt(sum)
+	default:
+		norms := math.Sqrt(dot(a, a)) * math.Sqrt(dot(b, b))
+		if norms == 0 {
+			return 1
+		}
+		return 1 - dot(a, b)/norms
+	}
+}
+
+// dot returns the inner product of two vectors of equal length.
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// toVector converts a decoded JSON array of numbers back into a vector.
+func toVector(v interface{}) ([]float64, bool) {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) == 0 {
+		return nil, false
+	}
+
+	vec := make([]float64, len(arr))
+	for i, x := range arr {
+		f, ok := x.(float64)
+		if !ok {
+			return nil, false
+		}
+		vec[i] = f
+	}
+
+	return vec, true
+}